@@ -15,17 +15,77 @@ export interface CreateSessionResponse {
   password?: string;
 }
 
+export interface Reservation {
+  slug: string;
+  accountId: string;
+  createdAt: string;
+}
+
+function authHeader(apiKey?: string): Record<string, string> {
+  return apiKey ? { Authorization: `Bearer ${apiKey}` } : {};
+}
+
+async function request<T>(url: string, init: RequestInit, what: string): Promise<T> {
+  const res = await fetch(url, init);
+  if (!res.ok) {
+    const text = await res.text();
+    throw new Error(`${what} failed: ${res.status} ${text}`);
+  }
+  return res.json() as Promise<T>;
+}
+
+export function createAccount(controlPlaneUrl: string): Promise<{ accountId: string; apiKey: string }> {
+  return request(`${controlPlaneUrl}/accounts`, { method: "POST" }, "Account creation");
+}
+
+export function listReservations(controlPlaneUrl: string, apiKey: string): Promise<{ reservations: Reservation[] }> {
+  return request(`${controlPlaneUrl}/reservations`, { headers: authHeader(apiKey) }, "Listing reservations");
+}
+
+export function reserveSlug(controlPlaneUrl: string, apiKey: string, slug: string): Promise<Reservation> {
+  return request(
+    `${controlPlaneUrl}/reservations`,
+    {
+      method: "POST",
+      headers: { "Content-Type": "application/json", ...authHeader(apiKey) },
+      body: JSON.stringify({ slug }),
+    },
+    "Reservation"
+  );
+}
+
+export function releaseSlug(controlPlaneUrl: string, apiKey: string, slug: string): Promise<{ ok: boolean }> {
+  return request(
+    `${controlPlaneUrl}/reservations/${encodeURIComponent(slug)}`,
+    { method: "DELETE", headers: authHeader(apiKey) },
+    "Release"
+  );
+}
+
 export async function createSession(
   controlPlaneUrl: string,
-  options: { port: number; auth?: boolean; expires?: string }
+  options: {
+    port: number;
+    auth?: boolean;
+    expires?: string;
+    captureOffline?: boolean;
+    edgeCache?: boolean;
+    errorPages?: Record<string, { title?: string; message?: string; html?: string }>;
+    slug?: string;
+    apiKey?: string;
+  }
 ): Promise<CreateSessionResponse> {
   const res = await fetch(`${controlPlaneUrl}/sessions`, {
     method: "POST",
-    headers: { "Content-Type": "application/json" },
+    headers: { "Content-Type": "application/json", ...authHeader(options.apiKey) },
     body: JSON.stringify({
       port: options.port,
       authMode: options.auth ? "basic" : "none",
       expiresIn: options.expires ?? "24h",
+      captureOffline: options.captureOffline ?? false,
+      edgeCache: options.edgeCache ?? false,
+      ...(options.errorPages && { errorPages: options.errorPages }),
+      ...(options.slug && { slug: options.slug }),
     }),
   });
 
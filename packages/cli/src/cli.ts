@@ -13,7 +13,7 @@ import { spawn } from "child_process";
 import { program } from "commander";
 import qrcode from "qrcode-terminal";
 import { TunnelClient } from "./tunnel.js";
-import { createSession } from "./api.js";
+import { createAccount, createSession, listReservations, releaseSlug, reserveSlug } from "./api.js";
 import type { CreateSessionResponse } from "./api.js";
 
 const require = createRequire(import.meta.url);
@@ -45,6 +45,65 @@ function writeSessionState(
   );
 }
 
+function getCredentialsPath(): string {
+  return path.join(path.dirname(getSessionStatePath()), "credentials.json");
+}
+
+/** API key from WORMKEY_API_KEY, --api-key, or the file written by `wormkey login`. */
+function resolveApiKey(opts: { apiKey?: string }): string | undefined {
+  if (process.env.WORMKEY_API_KEY) return process.env.WORMKEY_API_KEY;
+  if (opts.apiKey) return opts.apiKey;
+  try {
+    return (JSON.parse(fs.readFileSync(getCredentialsPath(), "utf8")) as { apiKey?: string }).apiKey;
+  } catch {
+    return undefined;
+  }
+}
+
+function requireApiKey(opts: { apiKey?: string }): string {
+  const apiKey = resolveApiKey(opts);
+  if (!apiKey) {
+    console.error("No API key. Run `wormkey login` or set WORMKEY_API_KEY.");
+    process.exit(1);
+  }
+  return apiKey;
+}
+
+function resolveControlPlane(opts: { controlPlane?: string; local?: boolean }): string {
+  const isLocal = process.env.WORMKEY_ENV === "local" || opts.local === true;
+  const defaultControlPlane = isLocal
+    ? "http://localhost:3001"
+    : "https://wormkey-control-plane.onrender.com";
+  return process.env.WORMKEY_CONTROL_PLANE_URL ?? opts.controlPlane ?? defaultControlPlane;
+}
+
+/** Error page kinds the gateway lets owners brand; `default` covers the rest. */
+const ERROR_PAGE_KINDS = [
+  "default",
+  "not_active",
+  "paused",
+  "locked",
+  "password",
+  "removed",
+  "too_many_viewers",
+  "blocked_path",
+  "connection_lost",
+];
+
+/** Reads `<kind>.html` templates from dir for --error-pages. */
+function readErrorPages(dir: string): Record<string, { html: string }> {
+  const pages: Record<string, { html: string }> = {};
+  for (const kind of ERROR_PAGE_KINDS) {
+    const file = path.join(dir, `${kind}.html`);
+    if (fs.existsSync(file)) pages[kind] = { html: fs.readFileSync(file, "utf8") };
+  }
+  if (Object.keys(pages).length === 0) {
+    console.error(`No error pages in ${dir}. Expected files like default.html or paused.html.`);
+    process.exit(1);
+  }
+  return pages;
+}
+
 function deleteSessionState(): void {
   try {
     fs.unlinkSync(getSessionStatePath());
@@ -82,6 +141,12 @@ program
   .description("Expose local port via wormhole")
   .option("--auth", "Enable basic auth (prints username/password)")
   .option("--expires <duration>", "Session expiry (e.g. 30m, 1h, 24h)", "24h")
+  .option("--capture-offline", "Queue webhooks at the edge while disconnected; deliver on reconnect")
+  .option("--error-pages <dir>", "Branded error pages: <kind>.html templates (default, paused, locked, ...)")
+  .option("--edge-cache", "Let the edge cache static assets your app marks cacheable (Cache-Control/ETag)")
+  .option("--no-compression", "Do not compress response bodies on the tunnel")
+  .option("--slug <slug>", "Use a slug reserved by your account (see `wormkey reserve`)")
+  .option("--api-key <key>", "Account API key (defaults to `wormkey login` credentials)")
   .option("--control-plane <url>", "Control plane URL")
   .option("--edge <url>", "Edge tunnel URL")
   .option("--local", "Use localhost control plane and edge")
@@ -95,23 +160,22 @@ program
     try {
       const isLocal =
         process.env.WORMKEY_ENV === "local" || opts.local === true;
-      const defaultControlPlane = isLocal
-        ? "http://localhost:3001"
-        : "https://wormkey-control-plane.onrender.com";
       const defaultEdge = isLocal
         ? "ws://localhost:3002/tunnel"
         : "wss://t.wormkey.run/tunnel";
 
-      const controlPlane =
-        process.env.WORMKEY_CONTROL_PLANE_URL ??
-        opts.controlPlane ??
-        defaultControlPlane;
+      const controlPlane = resolveControlPlane(opts);
       console.error("Control plane:", controlPlane);
 
       const session = await createSession(controlPlane, {
         port: portNum,
         auth: opts.auth,
         expires: opts.expires,
+        captureOffline: opts.captureOffline,
+        edgeCache: opts.edgeCache,
+        ...(opts.errorPages && { errorPages: readErrorPages(opts.errorPages) }),
+        slug: opts.slug,
+        apiKey: opts.slug ? requireApiKey(opts) : resolveApiKey(opts),
       });
 
       if (opts.auth && session.username && session.password) {
@@ -132,6 +196,7 @@ program
         edgeUrl,
         sessionToken: session.sessionToken,
         publicUrl: session.publicUrl,
+        compression: opts.compression,
         onStatus: (msg) => console.error(msg),
       });
 
@@ -229,11 +294,154 @@ program
     }
   });
 
+/** Runs `wormkey tcp` / `wormkey udp` / `wormkey tls`: a raw tunnel the gateway does not parse. */
+async function exposeRaw(mode: "tcp" | "udp" | "tls", port: string, opts: Record<string, string | boolean | undefined>) {
+  const portNum = parseInt(port, 10);
+  if (isNaN(portNum) || portNum < 1 || portNum > 65535) {
+    console.error("Invalid port. Use 1-65535.");
+    process.exit(1);
+  }
+
+  try {
+    const isLocal = process.env.WORMKEY_ENV === "local" || opts.local === true;
+    const controlPlane = resolveControlPlane(opts as { controlPlane?: string; local?: boolean });
+    const keyOpts = { apiKey: opts.apiKey as string | undefined };
+    const session = await createSession(controlPlane, {
+      port: portNum,
+      expires: opts.expires as string,
+      slug: opts.slug as string | undefined,
+      apiKey: opts.slug ? requireApiKey(keyOpts) : resolveApiKey(keyOpts),
+    });
+    const edgeUrl =
+      process.env.WORMKEY_EDGE_URL ??
+      (opts.edge as string | undefined) ??
+      session.edgeUrl ??
+      (isLocal ? "ws://localhost:3002/tunnel" : "wss://t.wormkey.run/tunnel");
+
+    let publicAddress = "";
+    const tunnel = new TunnelClient({
+      localPort: portNum,
+      edgeUrl,
+      sessionToken: session.sessionToken,
+      publicUrl: session.publicUrl,
+      mode,
+      onStatus: (msg) => console.error(msg),
+      onPublicAddress: (addr) => {
+        if (publicAddress && addr !== publicAddress) console.error(`Public address changed: ${addr}`);
+        publicAddress = addr;
+      },
+    });
+    await tunnel.connect();
+    writeSessionState(controlPlane, session);
+
+    const name = mode.toUpperCase();
+    console.log(`\n${name} tunnel ready.\n`);
+    console.log("Connect to:");
+    const setting = mode === "tls" ? "WORMKEY_PASSTHROUGH_ADDR" : `WORMKEY_${name}_PORTS`;
+    console.log(publicAddress || `(the gateway did not return a ${name} address; is ${setting} set?)`);
+    console.log("\nOwner claim URL (open once):");
+    console.log(session.ownerUrl);
+    console.log("\nPress Ctrl+C to close.\n");
+
+    process.on("SIGINT", () => {
+      deleteSessionState();
+      tunnel.close();
+      process.exit(0);
+    });
+  } catch (err) {
+    console.error("Error:", err instanceof Error ? err.message : err);
+    process.exit(1);
+  }
+}
+
+for (const [mode, description] of [
+  ["tcp", "Expose a local TCP port (databases, SSH, game servers) on a public port"],
+  ["udp", "Expose a local UDP port (game servers, VoIP) on a public port"],
+  ["tls", "Expose a local TLS server end-to-end; the gateway routes by SNI and never decrypts"],
+] as const) {
+  program
+    .command(`${mode} <port>`)
+    .description(description)
+    .option("--expires <duration>", "Session expiry (e.g. 30m, 1h, 24h)", "24h")
+    .option("--slug <slug>", "Use a slug reserved by your account (see `wormkey reserve`)")
+    .option("--api-key <key>", "Account API key (defaults to `wormkey login` credentials)")
+    .option("--control-plane <url>", "Control plane URL")
+    .option("--edge <url>", "Edge tunnel URL")
+    .option("--local", "Use localhost control plane and edge")
+    .action((port: string, opts) => exposeRaw(mode, port, opts));
+}
+
 program
   .command("login")
-  .description("Authenticate with Wormkey (device flow)")
-  .action(() => {
-    console.log("Login not implemented in v0. Use local control plane.");
+  .description("Save an account API key (creates a new account if none is given)")
+  .option("--api-key <key>", "Existing API key")
+  .option("--control-plane <url>", "Control plane URL")
+  .option("--local", "Use localhost control plane")
+  .action(async (opts) => {
+    try {
+      let apiKey: string = opts.apiKey;
+      if (!apiKey) {
+        const account = await createAccount(resolveControlPlane(opts));
+        apiKey = account.apiKey;
+        console.log(`Created account ${account.accountId}`);
+      }
+      const filePath = getCredentialsPath();
+      fs.mkdirSync(path.dirname(filePath), { recursive: true });
+      fs.writeFileSync(filePath, JSON.stringify({ apiKey }), { encoding: "utf8", mode: 0o600 });
+      console.log(`API key saved to ${filePath}`);
+    } catch (err) {
+      console.error("Error:", err instanceof Error ? err.message : err);
+      process.exit(1);
+    }
+  });
+
+program
+  .command("reserve <slug>")
+  .description("Reserve a slug for your account so its URL stays the same across runs")
+  .option("--api-key <key>", "Account API key")
+  .option("--control-plane <url>", "Control plane URL")
+  .option("--local", "Use localhost control plane")
+  .action(async (slug: string, opts) => {
+    try {
+      const reservation = await reserveSlug(resolveControlPlane(opts), requireApiKey(opts), slug);
+      console.log(`Reserved ${reservation.slug}. Run \`wormkey http <port> --slug ${reservation.slug}\` to use it.`);
+    } catch (err) {
+      console.error("Error:", err instanceof Error ? err.message : err);
+      process.exit(1);
+    }
+  });
+
+program
+  .command("release <slug>")
+  .description("Release a reserved slug")
+  .option("--api-key <key>", "Account API key")
+  .option("--control-plane <url>", "Control plane URL")
+  .option("--local", "Use localhost control plane")
+  .action(async (slug: string, opts) => {
+    try {
+      await releaseSlug(resolveControlPlane(opts), requireApiKey(opts), slug);
+      console.log(`Released ${slug}.`);
+    } catch (err) {
+      console.error("Error:", err instanceof Error ? err.message : err);
+      process.exit(1);
+    }
+  });
+
+program
+  .command("reservations")
+  .description("List slugs reserved by your account")
+  .option("--api-key <key>", "Account API key")
+  .option("--control-plane <url>", "Control plane URL")
+  .option("--local", "Use localhost control plane")
+  .action(async (opts) => {
+    try {
+      const { reservations } = await listReservations(resolveControlPlane(opts), requireApiKey(opts));
+      if (reservations.length === 0) console.log("No reserved slugs.");
+      for (const r of reservations) console.log(`${r.slug}  (since ${r.createdAt})`);
+    } catch (err) {
+      console.error("Error:", err instanceof Error ? err.message : err);
+      process.exit(1);
+    }
   });
 
 program
@@ -16,6 +16,9 @@ export const FrameType = {
   PONG: 0x0a,
   PAUSE: 0x0b,
   RESUME: 0x0c,
+  TCP_OPEN: 0x0d,
+  DATAGRAM: 0x0e,
+  RESPONSE_TRAILERS: 0x0f,
 } as const;
 
 export type FrameTypeId = (typeof FrameType)[keyof typeof FrameType];
@@ -35,10 +38,16 @@ export function createFrame(type: FrameTypeId | number, streamId: number, payloa
   return frame;
 }
 
-export function parseOpenStream(payload: Buffer): { method: string; path: string; headers: Record<string, string> } {
+export function parseOpenStream(payload: Buffer): {
+  method: string;
+  path: string;
+  /** Viewer's protocol version, e.g. "HTTP/1.1" or "HTTP/2.0". */
+  proto: string;
+  headers: Record<string, string>;
+} {
   const str = payload.toString("utf-8");
   const [firstLine, ...headerLines] = str.split("\r\n");
-  const [method, path] = firstLine.split(" ");
+  const [method, path, proto] = firstLine.split(" ");
   const headers: Record<string, string> = {};
   for (const line of headerLines) {
     const colon = line.indexOf(":");
@@ -46,11 +55,16 @@ export function parseOpenStream(payload: Buffer): { method: string; path: string
       headers[line.slice(0, colon).trim().toLowerCase()] = line.slice(colon + 1).trim();
     }
   }
-  return { method, path: path ?? "/", headers };
+  return { method, path: path ?? "/", proto: proto ?? "HTTP/1.1", headers };
 }
 
-export function serializeOpenStream(method: string, path: string, headers: Record<string, string>): Buffer {
-  const lines = [`${method} ${path} HTTP/1.1`, ...Object.entries(headers).map(([k, v]) => `${k}: ${v}`), "", ""];
+export function serializeOpenStream(
+  method: string,
+  path: string,
+  headers: Record<string, string>,
+  proto = "HTTP/1.1"
+): Buffer {
+  const lines = [`${method} ${path} ${proto}`, ...Object.entries(headers).map(([k, v]) => `${k}: ${v}`), "", ""];
   return Buffer.from(lines.join("\r\n"), "utf-8");
 }
 
@@ -72,3 +86,32 @@ export function serializeResponseHeaders(statusCode: number, headers: Record<str
   const lines = [`HTTP/1.1 ${statusCode}`, ...Object.entries(headers).map(([k, v]) => `${k}: ${v}`), "", ""];
   return Buffer.from(lines.join("\r\n"), "utf-8");
 }
+
+/** Trailers are a header block without a status line, sent before STREAM_END. */
+export function serializeTrailers(trailers: Record<string, string>): Buffer {
+  const lines = [...Object.entries(trailers).map(([k, v]) => `${k}: ${v}`), "", ""];
+  return Buffer.from(lines.join("\r\n"), "utf-8");
+}
+
+/** gRPC (not gRPC-Web, which works over HTTP/1.1) needs HTTP/2 to the local server. */
+export function isGrpcContentType(contentType: string | undefined): boolean {
+  return /^application\/grpc(\+|;|$)/.test(contentType ?? "");
+}
+
+// Bodies of these types are usually compressed already; deflating them again on the tunnel wastes CPU.
+const PRECOMPRESSED_TYPES = [
+  "image/", "video/", "audio/", "font/woff", "application/octet-stream", "application/pdf",
+  "application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+  "application/x-7z-compressed", "application/x-rar-compressed", "application/x-bzip2", "application/x-xz",
+];
+
+/** Whether a body with these (lower-case) headers is worth permessage-deflate on the tunnel. */
+export function isCompressibleBody(headers: Record<string, string | undefined>): boolean {
+  for (const k of ["content-encoding", "grpc-encoding"]) {
+    const v = headers[k]?.trim().toLowerCase();
+    if (v && v !== "identity") return false;
+  }
+  const ct = (headers["content-type"] ?? "").toLowerCase();
+  if (ct.startsWith("image/svg+xml")) return true;
+  return !PRECOMPRESSED_TYPES.some((t) => ct.startsWith(t));
+}
@@ -3,6 +3,9 @@
  * Connects to Edge via WebSocket, forwards HTTP/WS to localhost
  */
 
+import dgram from "node:dgram";
+import http2 from "node:http2";
+import net from "node:net";
 import WebSocket from "ws";
 import { request } from "undici";
 import {
@@ -11,16 +14,31 @@ import {
   readStreamId,
   parseOpenStream,
   serializeResponseHeaders,
+  serializeTrailers,
+  isGrpcContentType,
+  isCompressibleBody,
 } from "./protocol.js";
 
 const CONTROL_STREAM_ID = 0;
 
+// Connection-specific headers that HTTP/2 forbids.
+const H2_DROPPED_HEADERS = new Set(["host", "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"]);
+
 export interface TunnelConfig {
   localPort: number;
   edgeUrl: string;
   sessionToken: string;
   publicUrl: string;
+  /**
+   * "tcp" and "udp" carry raw connections or datagrams instead of HTTP requests. "tls" is
+   * TCP for TLS passthrough: the local service terminates TLS itself.
+   */
+  mode?: "http" | "tcp" | "udp" | "tls";
+  /** Negotiate permessage-deflate for response bodies (default true). */
+  compression?: boolean;
   onStatus?: (msg: string) => void;
+  /** Called with the public host:port each time a TCP or UDP tunnel connects. */
+  onPublicAddress?: (addr: string) => void;
 }
 
 const PING_INTERVAL_MS = 25000;
@@ -35,6 +53,11 @@ export class TunnelClient {
   private pingTimer: ReturnType<typeof setTimeout> | null = null;
   private pongTimeout: ReturnType<typeof setTimeout> | null = null;
   private pendingStreams = new Map<number, { openPayload: Buffer; bodyChunks: Buffer[] }>();
+  private tcpSockets = new Map<number, net.Socket>();
+  private udpSockets = new Map<number, dgram.Socket>();
+  private grpcStreams = new Map<number, http2.ClientHttp2Stream>();
+  private httpRequests = new Map<number, AbortController>();
+  private h2Session: http2.ClientHttp2Session | null = null;
   private shouldRun = true;
   private reconnectAttempt = 0;
   private heartbeatFailures = 0;
@@ -66,10 +89,16 @@ export class TunnelClient {
 
   private openSocket() {
     const url = this.config.edgeUrl.replace(/^http/, "ws");
-    this.ws = new WebSocket(url, {
-      headers: {
-        Authorization: `Bearer ${this.config.sessionToken}`,
-      },
+    const headers: Record<string, string> = {
+      Authorization: `Bearer ${this.config.sessionToken}`,
+    };
+    const mode = this.config.mode ?? "http";
+    if (mode !== "http") headers["X-Wormkey-Tunnel-Mode"] = mode;
+    this.ws = new WebSocket(url, { headers, perMessageDeflate: this.config.compression !== false });
+
+    this.ws.on("upgrade", (res) => {
+      const addr = res.headers[`x-wormkey-${mode}-addr`];
+      if (typeof addr === "string") this.config.onPublicAddress?.(addr);
     });
 
     this.ws.on("open", () => {
@@ -110,6 +139,50 @@ export class TunnelClient {
       return;
     }
 
+    if (type === FrameType.TCP_OPEN) {
+      this.handleTcpOpen(streamId);
+      return;
+    }
+
+    if (type === FrameType.DATAGRAM && payload) {
+      this.handleDatagram(streamId, payload);
+      return;
+    }
+
+    const udpSocket = this.udpSockets.get(streamId);
+    if (udpSocket && (type === FrameType.STREAM_END || type === FrameType.STREAM_CANCEL)) {
+      this.udpSockets.delete(streamId);
+      udpSocket.close();
+      return;
+    }
+
+    const socket = this.tcpSockets.get(streamId);
+    if (socket) {
+      if (type === FrameType.STREAM_DATA && payload) socket.write(payload);
+      else if (type === FrameType.STREAM_END) socket.end();
+      else if (type === FrameType.STREAM_CANCEL) {
+        this.tcpSockets.delete(streamId);
+        socket.destroy();
+      }
+      return;
+    }
+
+    const grpcStream = this.grpcStreams.get(streamId);
+    if (grpcStream) {
+      if (type === FrameType.STREAM_DATA && payload) grpcStream.write(payload);
+      else if (type === FrameType.STREAM_END) grpcStream.end();
+      else if (type === FrameType.STREAM_CANCEL) {
+        this.grpcStreams.delete(streamId);
+        grpcStream.close(http2.constants.NGHTTP2_CANCEL);
+      }
+      return;
+    }
+
+    if (type === FrameType.OPEN_STREAM && payload && isGrpcContentType(parseOpenStream(payload).headers["content-type"])) {
+      this.handleGrpcStream(streamId, payload);
+      return;
+    }
+
     if (type === FrameType.OPEN_STREAM && payload) {
       this.pendingStreams.set(streamId, { openPayload: payload, bodyChunks: [] });
       return;
@@ -132,6 +205,7 @@ export class TunnelClient {
 
     if (type === FrameType.STREAM_CANCEL) {
       this.pendingStreams.delete(streamId);
+      this.httpRequests.get(streamId)?.abort();
       return;
     }
   }
@@ -141,12 +215,19 @@ export class TunnelClient {
     const body = bodyChunks.length > 0 ? Buffer.concat(bodyChunks) : undefined;
 
     const localUrl = `http://127.0.0.1:${this.config.localPort}${path}`;
+    const controller = new AbortController();
+    this.httpRequests.set(streamId, controller);
 
     try {
-      const { statusCode, headers: resHeaders, body: resBody } = await request(localUrl, {
+      const { statusCode, headers: resHeaders, body: resBody, trailers } = await request(localUrl, {
         method: method as "GET" | "POST" | "PUT" | "PATCH" | "DELETE" | "HEAD" | "OPTIONS",
         headers: headers as Record<string, string>,
         body,
+        signal: controller.signal,
+        // SSE and long-poll responses may stay quiet for minutes; the edge cancels the
+        // stream when the viewer goes away.
+        headersTimeout: 0,
+        bodyTimeout: 0,
       });
 
       const resHeadersObj: Record<string, string> = {};
@@ -155,24 +236,114 @@ export class TunnelClient {
         else if (Array.isArray(v)) resHeadersObj[k] = v.join(", ");
       }
       this.send(FrameType.RESPONSE_HEADERS, streamId, serializeResponseHeaders(statusCode, resHeadersObj));
+      const compress = isCompressibleBody(resHeadersObj);
 
       // Stream chunks as they arrive (don't buffer) so Next.js RSC and streaming responses render progressively
       for await (const chunk of resBody) {
         if (chunk && chunk.length > 0) {
-          this.send(FrameType.STREAM_DATA, streamId, Buffer.from(chunk));
+          this.send(FrameType.STREAM_DATA, streamId, Buffer.from(chunk), compress);
         }
       }
+      // undici fills trailers once the body has been read
+      if (Object.keys(trailers).length > 0) {
+        this.send(FrameType.RESPONSE_TRAILERS, streamId, serializeTrailers(trailers));
+      }
     } catch (err) {
+      this.httpRequests.delete(streamId);
+      if (controller.signal.aborted) return;
       const msg = err instanceof Error ? err.message : String(err);
       this.send(FrameType.RESPONSE_HEADERS, streamId, serializeResponseHeaders(502, { "content-type": "text/plain" }));
       this.send(FrameType.STREAM_DATA, streamId, Buffer.from(`Bad Gateway: ${msg}`, "utf-8"));
     }
+    this.httpRequests.delete(streamId);
     this.send(FrameType.STREAM_END, streamId);
   }
 
-  private send(type: number, streamId: number, payload?: Buffer) {
+  private getH2Session(): http2.ClientHttp2Session {
+    if (!this.h2Session || this.h2Session.closed || this.h2Session.destroyed) {
+      const session = http2.connect(`http://127.0.0.1:${this.config.localPort}`);
+      session.on("error", () => {});
+      session.on("close", () => {
+        if (this.h2Session === session) this.h2Session = null;
+      });
+      this.h2Session = session;
+    }
+    return this.h2Session;
+  }
+
+  /**
+   * gRPC streams are proxied over HTTP/2 as they arrive (no body buffering) so client, server
+   * and bidi streaming RPCs work. grpc-status comes back in RESPONSE_TRAILERS.
+   */
+  private handleGrpcStream(streamId: number, openStreamPayload: Buffer) {
+    const { method, path, headers } = parseOpenStream(openStreamPayload);
+    const h2Headers: http2.OutgoingHttpHeaders = { ":method": method, ":path": path };
+    for (const [k, v] of Object.entries(headers)) {
+      if (!H2_DROPPED_HEADERS.has(k)) h2Headers[k] = v;
+    }
+    let req: http2.ClientHttp2Stream;
+    try {
+      req = this.getH2Session().request(h2Headers);
+    } catch {
+      this.send(FrameType.STREAM_CANCEL, streamId);
+      return;
+    }
+    this.grpcStreams.set(streamId, req);
+    let compress = false;
+    req.on("response", (resHeaders) => {
+      const statusCode = Number(resHeaders[":status"] ?? 200);
+      const record = toHeaderRecord(resHeaders);
+      compress = isCompressibleBody(record);
+      this.send(FrameType.RESPONSE_HEADERS, streamId, serializeResponseHeaders(statusCode, record));
+    });
+    req.on("data", (chunk: Buffer) => this.send(FrameType.STREAM_DATA, streamId, chunk, compress));
+    req.on("trailers", (trailers) => {
+      this.send(FrameType.RESPONSE_TRAILERS, streamId, serializeTrailers(toHeaderRecord(trailers)));
+    });
+    req.on("end", () => {
+      if (this.grpcStreams.delete(streamId)) this.send(FrameType.STREAM_END, streamId);
+    });
+    req.on("error", () => {
+      if (this.grpcStreams.delete(streamId)) this.send(FrameType.STREAM_CANCEL, streamId);
+    });
+  }
+
+  /** Pipes one public TCP connection to the local port. STREAM_END is a half-close. */
+  private handleTcpOpen(streamId: number) {
+    const socket = net.connect({ port: this.config.localPort, host: "127.0.0.1", allowHalfOpen: true });
+    this.tcpSockets.set(streamId, socket);
+    socket.on("data", (chunk: Buffer) => this.send(FrameType.STREAM_DATA, streamId, chunk));
+    socket.on("end", () => this.send(FrameType.STREAM_END, streamId));
+    socket.on("error", () => {
+      if (this.tcpSockets.delete(streamId)) this.send(FrameType.STREAM_CANCEL, streamId);
+    });
+    socket.on("close", () => this.tcpSockets.delete(streamId));
+  }
+
+  /** Each remote address gets its own local UDP socket so replies reach the right sender. */
+  private handleDatagram(streamId: number, payload: Buffer) {
+    let socket = this.udpSockets.get(streamId);
+    if (!socket) {
+      const created = dgram.createSocket("udp4");
+      created.on("message", (msg: Buffer) => this.send(FrameType.DATAGRAM, streamId, msg));
+      created.on("error", () => {
+        if (this.udpSockets.delete(streamId)) this.send(FrameType.STREAM_CANCEL, streamId);
+        created.close();
+      });
+      this.udpSockets.set(streamId, created);
+      socket = created;
+    }
+    socket.send(payload, this.config.localPort, "127.0.0.1");
+  }
+
+  /**
+   * compress deflates the frame when the tunnel negotiated permessage-deflate (ws skips
+   * frames under 1 KiB). Only bodies that are not already compressed use it; headers are
+   * never compressed, so cookies and tokens cannot leak through compressed sizes (CRIME).
+   */
+  private send(type: number, streamId: number, payload?: Buffer, compress = false) {
     if (this.ws?.readyState === WebSocket.OPEN) {
-      this.ws.send(createFrame(type, streamId, payload));
+      this.ws.send(createFrame(type, streamId, payload), { compress });
     }
   }
 
@@ -207,6 +378,14 @@ export class TunnelClient {
   private handleClose() {
     this.ws = null;
     this.stopHeartbeat();
+    for (const socket of this.tcpSockets.values()) socket.destroy();
+    this.tcpSockets.clear();
+    for (const socket of this.udpSockets.values()) socket.close();
+    this.udpSockets.clear();
+    for (const stream of this.grpcStreams.values()) stream.close(http2.constants.NGHTTP2_CANCEL);
+    this.grpcStreams.clear();
+    for (const controller of this.httpRequests.values()) controller.abort();
+    this.httpRequests.clear();
 
     if (!this.shouldRun) return;
     if (this.reconnectTimer) return;
@@ -241,3 +420,13 @@ export class TunnelClient {
     this.send(FrameType.RESUME, CONTROL_STREAM_ID);
   }
 }
+
+/** Flattens HTTP/2 headers (dropping pseudo-headers) for RESPONSE_HEADERS / RESPONSE_TRAILERS. */
+function toHeaderRecord(headers: http2.IncomingHttpHeaders): Record<string, string> {
+  const out: Record<string, string> = {};
+  for (const [k, v] of Object.entries(headers)) {
+    if (k.startsWith(":") || v === undefined) continue;
+    out[k] = Array.isArray(v) ? v.join(", ") : String(v);
+  }
+  return out;
+}
@@ -3,7 +3,10 @@
  * Session creation, slug allocation, lifecycle
  */
 
-import Fastify from "fastify";
+import { createHash, createHmac, randomBytes, timingSafeEqual } from "node:crypto";
+import * as fs from "node:fs";
+import * as path from "node:path";
+import Fastify, { type FastifyRequest } from "fastify";
 import cors from "@fastify/cors";
 
 const ADJECTIVES = [
@@ -31,18 +34,152 @@ function randomToken(): string {
   return s;
 }
 
+/** Offline webhook capture: gateway queues requests while the tunnel is disconnected. */
+interface CapturePolicy {
+  enabled: boolean;
+  status?: number;
+  body?: string;
+  contentType?: string;
+}
+
+/** Edge cache: gateway serves cacheable responses without a tunnel round trip. */
+interface CachePolicy {
+  enabled: boolean;
+  paths?: string[];
+}
+
+/** Branded gateway error page for one kind (not_active, paused, ...) or "default". */
+interface ErrorPage {
+  title?: string;
+  message?: string;
+  html?: string;
+}
+
+/** Per-path webhook signature rule, verified by the gateway before forwarding. */
+interface SignatureRule {
+  path: string;
+  scheme: "stripe" | "github" | "slack" | "hmac";
+  secret: string;
+  header?: string;
+  algorithm?: "sha1" | "sha256" | "sha512";
+  encoding?: "hex" | "base64";
+  prefix?: string;
+  timestampHeader?: string;
+  tolerance?: number;
+}
+
+/** Account-owned slug that survives across sessions until the owner releases it. */
+interface Reservation {
+  slug: string;
+  accountId: string;
+  createdAt: string;
+}
+
+interface Account {
+  id: string;
+  /** sha256 of the API key; the key itself is only shown once at creation. */
+  keyHash: string;
+  createdAt: string;
+}
+
+const SLUG_PATTERN = /^[a-z0-9][a-z0-9-]{1,30}[a-z0-9]$/;
+const UNRESERVABLE_SLUGS = new Set(["www", "api", "app", "admin", "s", "t", "edge", "tunnel", "status", "docs", "mail"]);
+const RESERVATIONS_FILE = process.env.WORMKEY_RESERVATIONS_FILE ?? "data/reservations.json";
+
+function hashKey(apiKey: string): string {
+  return createHash("sha256").update(apiKey).digest("hex");
+}
+
 const PUBLIC_BASE_URL =
   process.env.WORMKEY_PUBLIC_BASE_URL ?? "http://localhost:3002";
 const EDGE_BASE_URL =
   process.env.WORMKEY_EDGE_BASE_URL ?? "ws://localhost:3002";
+// Shared with the gateway. When set, /sessions/by-slug/* and /reservations/by-slug/* only accept HMAC-signed gateway requests.
+const GATEWAY_SECRET = process.env.WORMKEY_CONTROL_PLANE_SECRET ?? "";
+const SIGNATURE_MAX_SKEW_SEC = 300;
+
+/**
+ * Verify X-Wormkey-Signature: v1=hex(hmac_sha256(secret, "<ts>\n<METHOD>\n<path>\n<hex sha256(body)>")).
+ * Mirrors signControlPlaneRequest in the gateway.
+ */
+function verifyGatewaySignature(req: FastifyRequest, rawBody: string): boolean {
+  const ts = req.headers["x-wormkey-timestamp"];
+  const sig = req.headers["x-wormkey-signature"];
+  if (typeof ts !== "string" || typeof sig !== "string" || !sig.startsWith("v1=")) return false;
+  const tsNum = parseInt(ts, 10);
+  if (!Number.isFinite(tsNum) || Math.abs(Date.now() / 1000 - tsNum) > SIGNATURE_MAX_SKEW_SEC) return false;
+  const path = req.url.split("?")[0];
+  const bodyHash = createHash("sha256").update(rawBody).digest("hex");
+  const expected = createHmac("sha256", GATEWAY_SECRET)
+    .update(`${ts}\n${req.method}\n${path}\n${bodyHash}`)
+    .digest();
+  const given = Buffer.from(sig.slice(3), "hex");
+  return given.length === expected.length && timingSafeEqual(given, expected);
+}
 
 async function main() {
   const fastify = Fastify({ logger: true });
 
+  const accounts = new Map<string, Account>(); // keyHash -> account
+  const reservations = new Map<string, Reservation>(); // slug -> reservation
+
+  try {
+    const saved = JSON.parse(fs.readFileSync(RESERVATIONS_FILE, "utf8")) as {
+      accounts?: Account[];
+      reservations?: Reservation[];
+    };
+    for (const a of saved.accounts ?? []) accounts.set(a.keyHash, a);
+    for (const r of saved.reservations ?? []) reservations.set(r.slug, r);
+  } catch {
+    // first run
+  }
+
+  function saveReservations(): void {
+    fs.mkdirSync(path.dirname(RESERVATIONS_FILE), { recursive: true });
+    const tmp = `${RESERVATIONS_FILE}.tmp`;
+    fs.writeFileSync(
+      tmp,
+      JSON.stringify({ accounts: [...accounts.values()], reservations: [...reservations.values()] }, null, 2),
+      { mode: 0o600 }
+    );
+    fs.renameSync(tmp, RESERVATIONS_FILE);
+  }
+
+  /** Resolve `Authorization: Bearer <apiKey>` to an account. */
+  function accountFor(req: FastifyRequest): Account | undefined {
+    const auth = req.headers.authorization;
+    if (!auth?.startsWith("Bearer ")) return undefined;
+    return accounts.get(hashKey(auth.slice(7).trim()));
+  }
+
   fastify.log.info({ PUBLIC_BASE_URL, EDGE_BASE_URL }, "Resolved Wormkey base URLs");
 
   await fastify.register(cors, { origin: true });
 
+  // Keep the raw JSON body around so gateway signatures can be checked byte-for-byte.
+  fastify.addContentTypeParser("application/json", { parseAs: "string" }, (req, body, done) => {
+    const raw = typeof body === "string" ? body : body.toString("utf-8");
+    (req as FastifyRequest & { rawBody?: string }).rawBody = raw;
+    if (raw === "") return done(null, {});
+    try {
+      done(null, JSON.parse(raw));
+    } catch (err) {
+      done(err as Error, undefined);
+    }
+  });
+
+  if (GATEWAY_SECRET) {
+    fastify.addHook("preHandler", async (req, reply) => {
+      if (!req.url.startsWith("/sessions/by-slug/") && !req.url.startsWith("/reservations/by-slug/")) return;
+      const rawBody = (req as FastifyRequest & { rawBody?: string }).rawBody ?? "";
+      if (!verifyGatewaySignature(req, rawBody)) {
+        return reply.status(401).send({ error: "Invalid gateway signature" });
+      }
+    });
+  } else {
+    fastify.log.warn("WORMKEY_CONTROL_PLANE_SECRET not set; /sessions/by-slug endpoints are unauthenticated");
+  }
+
   fastify.get("/", async (_req, reply) => {
     return reply.send({ status: "control plane alive" });
   });
@@ -54,6 +191,21 @@ async function main() {
   // In-memory session store (v0)
   const sessions = new Map<string, Session>();
 
+  /** Newest open session for slug, else the newest closed one (reserved slugs are reused). */
+  function findBySlug(slug: string): Session | undefined {
+    let found: Session | undefined;
+    for (const session of sessions.values()) {
+      if (session.slug !== slug) continue;
+      if (!found || (found.closed && !session.closed) || found.closed === session.closed) found = session;
+    }
+    return found;
+  }
+
+  function slugInUse(slug: string): boolean {
+    const s = findBySlug(slug);
+    return !!s && !s.closed && new Date(s.expiresAt).getTime() > Date.now();
+  }
+
   interface Session {
     sessionId: string;
     slug: string;
@@ -71,20 +223,42 @@ async function main() {
       maxConcurrentViewers: number;
       blockPaths: string[];
       password: string;
+      capture?: CapturePolicy;
+      signatures?: SignatureRule[];
+      cache?: CachePolicy;
+      errorPages?: Record<string, ErrorPage>;
     };
     activeViewers: Array<{ id: string; lastSeenAt: string; requests: number; ip?: string }>;
     kickedViewerIds: string[];
     closed: boolean;
+    accountId?: string;
     username?: string;
     password?: string;
   }
 
   fastify.post<{
-    Body: { port?: number; authMode?: string; expiresIn?: string };
+    Body: { port?: number; authMode?: string; expiresIn?: string; captureOffline?: boolean; edgeCache?: boolean; errorPages?: Record<string, ErrorPage>; slug?: string };
   }>("/sessions", async (req, reply) => {
-    const { port = 3000, authMode = "none", expiresIn = "24h" } = req.body ?? {};
+    const { port = 3000, authMode = "none", expiresIn = "24h", captureOffline = false, edgeCache = false } = req.body ?? {};
+    const account = accountFor(req);
 
-    const slug = randomSlug();
+    let slug: string;
+    if (req.body?.slug) {
+      const reservation = reservations.get(req.body.slug);
+      if (!account || !reservation || reservation.accountId !== account.id) {
+        return reply.status(403).send({ error: "Slug is not reserved by this account" });
+      }
+      slug = reservation.slug;
+      // A new run takes over the reserved slug from any earlier session.
+      for (const session of sessions.values()) {
+        if (session.slug === slug) session.closed = true;
+      }
+    } else {
+      let attempts = 0;
+      do {
+        slug = randomSlug();
+      } while ((reservations.has(slug) || slugInUse(slug)) && ++attempts < 50);
+    }
     const ownerToken = randomToken();
     const sessionToken = `${slug}.${ownerToken}`;
     const sessionId = `sess_${randomToken()}`;
@@ -122,10 +296,14 @@ async function main() {
         maxConcurrentViewers: 20,
         blockPaths: [],
         password: "",
+        ...(captureOffline && { capture: { enabled: true } }),
+        ...(edgeCache && { cache: { enabled: true } }),
+        ...(req.body?.errorPages && { errorPages: req.body.errorPages }),
       },
       activeViewers: [],
       kickedViewerIds: [],
       closed: false,
+      ...(account && { accountId: account.id }),
     };
 
     if (authMode === "basic") {
@@ -164,29 +342,26 @@ async function main() {
 
   fastify.get("/sessions/by-slug/:slug", async (req, reply) => {
     const { slug } = req.params as { slug: string };
-    let found: Session | undefined;
-    for (const session of sessions.values()) {
-      if (session.slug === slug) {
-        found = session;
-        break;
-      }
-    }
+    const found = findBySlug(slug);
     if (!found) return reply.status(404).send({ error: "Session not found" });
     return found;
   });
 
   fastify.post<{
     Params: { slug: string };
-    Body: { public?: boolean; maxConcurrentViewers?: number; blockPaths?: string[]; password?: string };
+    Body: {
+      public?: boolean;
+      maxConcurrentViewers?: number;
+      blockPaths?: string[];
+      password?: string;
+      capture?: CapturePolicy | null;
+      signatures?: SignatureRule[];
+      cache?: CachePolicy | null;
+      errorPages?: Record<string, ErrorPage> | null;
+    };
   }>("/sessions/by-slug/:slug/policy", async (req, reply) => {
     const { slug } = req.params;
-    let found: Session | undefined;
-    for (const session of sessions.values()) {
-      if (session.slug === slug) {
-        found = session;
-        break;
-      }
-    }
+    const found = findBySlug(slug);
     if (!found) return reply.status(404).send({ error: "Session not found" });
 
     if (typeof req.body.public === "boolean") found.policy.public = req.body.public;
@@ -195,6 +370,13 @@ async function main() {
     }
     if (Array.isArray(req.body.blockPaths)) found.policy.blockPaths = req.body.blockPaths;
     if (typeof req.body.password === "string") found.policy.password = req.body.password;
+    if (req.body.capture === null) delete found.policy.capture;
+    else if (req.body.capture && typeof req.body.capture.enabled === "boolean") found.policy.capture = req.body.capture;
+    if (Array.isArray(req.body.signatures)) found.policy.signatures = req.body.signatures;
+    if (req.body.cache === null) delete found.policy.cache;
+    else if (req.body.cache && typeof req.body.cache.enabled === "boolean") found.policy.cache = req.body.cache;
+    if (req.body.errorPages === null) delete found.policy.errorPages;
+    else if (req.body.errorPages && typeof req.body.errorPages === "object") found.policy.errorPages = req.body.errorPages;
     return reply.send({ ok: true, policy: found.policy });
   });
 
@@ -203,13 +385,7 @@ async function main() {
     Body: { viewers: Array<{ id: string; lastSeenAt: string; requests: number; ip?: string }> };
   }>("/sessions/by-slug/:slug/viewers", async (req, reply) => {
     const { slug } = req.params;
-    let found: Session | undefined;
-    for (const session of sessions.values()) {
-      if (session.slug === slug) {
-        found = session;
-        break;
-      }
-    }
+    const found = findBySlug(slug);
     if (!found) return reply.status(404).send({ error: "Session not found" });
     found.activeViewers = req.body.viewers ?? [];
     return reply.send({ ok: true });
@@ -220,13 +396,7 @@ async function main() {
     Body: { viewerId: string };
   }>("/sessions/by-slug/:slug/kick", async (req, reply) => {
     const { slug } = req.params;
-    let found: Session | undefined;
-    for (const session of sessions.values()) {
-      if (session.slug === slug) {
-        found = session;
-        break;
-      }
-    }
+    const found = findBySlug(slug);
     if (!found) return reply.status(404).send({ error: "Session not found" });
     if (req.body.viewerId && !found.kickedViewerIds.includes(req.body.viewerId)) {
       found.kickedViewerIds.push(req.body.viewerId);
@@ -237,18 +407,70 @@ async function main() {
 
   fastify.post<{ Params: { slug: string } }>("/sessions/by-slug/:slug/close", async (req, reply) => {
     const { slug } = req.params;
-    let found: Session | undefined;
-    for (const session of sessions.values()) {
-      if (session.slug === slug) {
-        found = session;
-        break;
-      }
-    }
+    const found = findBySlug(slug);
     if (!found) return reply.status(404).send({ error: "Session not found" });
     found.closed = true;
     return reply.send({ ok: true });
   });
 
+  fastify.post("/accounts", async (_req, reply) => {
+    const apiKey = `wk_${randomBytes(24).toString("hex")}`;
+    const account: Account = {
+      id: `acct_${randomBytes(8).toString("hex")}`,
+      keyHash: hashKey(apiKey),
+      createdAt: new Date().toISOString(),
+    };
+    accounts.set(account.keyHash, account);
+    saveReservations();
+    return reply.status(201).send({ accountId: account.id, apiKey });
+  });
+
+  fastify.get("/reservations", async (req, reply) => {
+    const account = accountFor(req);
+    if (!account) return reply.status(401).send({ error: "API key required" });
+    return { reservations: [...reservations.values()].filter((r) => r.accountId === account.id) };
+  });
+
+  fastify.post<{ Body: { slug?: string } }>("/reservations", async (req, reply) => {
+    const account = accountFor(req);
+    if (!account) return reply.status(401).send({ error: "API key required" });
+    const slug = (req.body?.slug ?? "").toLowerCase();
+    if (!SLUG_PATTERN.test(slug) || UNRESERVABLE_SLUGS.has(slug)) {
+      return reply.status(400).send({ error: "Slug must be 3-32 characters of a-z, 0-9 and -" });
+    }
+    const existing = reservations.get(slug);
+    if (existing) {
+      if (existing.accountId === account.id) return reply.send(existing);
+      return reply.status(409).send({ error: "Slug is reserved" });
+    }
+    const current = findBySlug(slug);
+    if (slugInUse(slug) && current?.accountId !== account.id) {
+      return reply.status(409).send({ error: "Slug is in use" });
+    }
+    const reservation: Reservation = { slug, accountId: account.id, createdAt: new Date().toISOString() };
+    reservations.set(slug, reservation);
+    saveReservations();
+    return reply.status(201).send(reservation);
+  });
+
+  fastify.delete<{ Params: { slug: string } }>("/reservations/:slug", async (req, reply) => {
+    const account = accountFor(req);
+    if (!account) return reply.status(401).send({ error: "API key required" });
+    const existing = reservations.get(req.params.slug);
+    if (!existing) return reply.status(404).send({ error: "Reservation not found" });
+    if (existing.accountId !== account.id) return reply.status(403).send({ error: "Not your reservation" });
+    reservations.delete(req.params.slug);
+    saveReservations();
+    return reply.send({ ok: true });
+  });
+
+  // Gateway lookup (signed like /sessions/by-slug/*).
+  fastify.get<{ Params: { slug: string } }>("/reservations/by-slug/:slug", async (req, reply) => {
+    const reservation = reservations.get(req.params.slug);
+    if (!reservation) return reply.status(404).send({ error: "Reservation not found" });
+    return reservation;
+  });
+
   const port = parseInt(process.env.PORT ?? "3001", 10);
   await fastify.listen({ port, host: "0.0.0.0" });
   console.log(`Control plane listening on :${port}`);
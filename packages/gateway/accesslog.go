@@ -0,0 +1,64 @@
+// Structured (JSON) access logging for proxied viewer requests.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// requestIDHeader is set on the OPEN_STREAM request and the viewer response so a
+// request can be followed from the edge into the local app's own logs.
+const requestIDHeader = "X-Wormkey-Request-Id"
+
+var accessLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// accessEntry collects what handleProxy learns about a request; logged once when it finishes.
+type accessEntry struct {
+	requestID string
+	slug      string
+	streamID  uint32
+	viewerID  string
+	owner     bool
+	rejection string // empty when the request was forwarded to the tunnel
+	detail    string // why the request was rejected, when the reason alone is not enough
+}
+
+func newRequestID() string {
+	if id := randomSecret(8); id != "" {
+		return id
+	}
+	return "req-" + time.Now().UTC().Format("20060102T150405.000000000")
+}
+
+func logAccess(r *http.Request, e *accessEntry, rec *responseRecorder, d time.Duration) {
+	attrs := []slog.Attr{
+		slog.String("requestId", e.requestID),
+		slog.String("slug", e.slug),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("proto", r.Proto),
+		slog.Int("status", rec.statusCode()),
+		slog.Int64("bytesIn", rec.bytesIn.Load()),
+		slog.Int64("bytesOut", rec.bytes),
+		slog.Float64("durationMs", float64(d.Microseconds())/1000),
+		slog.Bool("owner", e.owner),
+		slog.String("remoteAddr", r.RemoteAddr),
+	}
+	if e.streamID != 0 {
+		attrs = append(attrs, slog.Uint64("streamId", uint64(e.streamID)))
+	}
+	if e.viewerID != "" {
+		attrs = append(attrs, slog.String("viewerId", e.viewerID))
+	}
+	if e.rejection != "" {
+		attrs = append(attrs, slog.String("rejection", e.rejection))
+	}
+	if e.detail != "" {
+		attrs = append(attrs, slog.String("rejectionDetail", e.detail))
+	}
+	accessLogger.LogAttrs(context.Background(), slog.LevelInfo, "access", attrs...)
+}
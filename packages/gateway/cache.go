@@ -0,0 +1,448 @@
+// Edge cache for tunnels that opt in with policy.cache. GET responses the app marks
+// cacheable (Cache-Control max-age/s-maxage or Expires, or just a validator) are kept per
+// tunnel, keyed by request URI and Vary, and served without opening a stream while fresh.
+// Stale entries are revalidated through the tunnel with If-None-Match/If-Modified-Since,
+// and a 304 refreshes the entry. The owner bypasses the cache and can purge it.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const cacheStatusHeader = "X-Wormkey-Cache"
+
+var (
+	cacheMaxBytes      int64 = 16 << 20 // per tunnel; WORMKEY_CACHE_MAX_BYTES
+	cacheMaxEntryBytes int64 = 8 << 20
+	cacheTotalMaxBytes int64 = 512 << 20 // all tunnels together; WORMKEY_CACHE_TOTAL_BYTES
+)
+
+// cacheTotalBytes is what the caches of all connected tunnels hold together.
+var cacheTotalBytes atomic.Int64
+
+type cachePolicy struct {
+	Enabled bool     `json:"enabled"`
+	Paths   []string `json:"paths,omitempty"` // path prefixes to cache; empty = any path
+}
+
+func (cp *cachePolicy) covers(path string) bool {
+	if cp == nil || !cp.Enabled {
+		return false
+	}
+	if len(cp.Paths) == 0 {
+		return true
+	}
+	for _, p := range cp.Paths {
+		if p != "" && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheEntry is immutable once stored; revalidation stores a refreshed copy.
+type cacheEntry struct {
+	key        string
+	vary       []string // canonical request header names the response varies on
+	varyValues []string
+	status     int
+	header     http.Header
+	body       []byte
+	storedAt   time.Time
+	ttl        time.Duration
+}
+
+func (e *cacheEntry) size() int64 { return int64(len(e.body)) + int64(len(e.key)) + 512 }
+
+func (e *cacheEntry) fresh(now time.Time) bool { return now.Sub(e.storedAt) < e.ttl }
+
+func (e *cacheEntry) matches(r *http.Request) bool {
+	for i, name := range e.vary {
+		if strings.Join(r.Header.Values(name), ", ") != e.varyValues[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type edgeCache struct {
+	mu      sync.Mutex
+	lru     *list.List                 // front = most recently used *cacheEntry
+	entries map[string][]*list.Element // key -> variants
+	bytes   int64
+	closed  bool // the tunnel is gone; nothing more is stored
+	hits    atomic.Int64
+	misses  atomic.Int64
+}
+
+func newEdgeCache() *edgeCache {
+	return &edgeCache{lru: list.New(), entries: map[string][]*list.Element{}}
+}
+
+func cacheKey(r *http.Request) string { return r.URL.RequestURI() }
+
+func (c *edgeCache) lookup(r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.entries[cacheKey(r)] {
+		if e := el.Value.(*cacheEntry); e.matches(r) {
+			c.lru.MoveToFront(el)
+			return e
+		}
+	}
+	return nil
+}
+
+func (c *edgeCache) store(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	variants := c.entries[e.key]
+	for i, el := range variants {
+		if old := el.Value.(*cacheEntry); sameVariant(old, e) {
+			c.account(-old.size())
+			c.lru.Remove(el)
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	c.entries[e.key] = append(variants, c.lru.PushFront(e))
+	c.account(e.size())
+	for c.bytes > cacheMaxBytes && c.lru.Len() > 1 {
+		c.remove(c.lru.Back())
+	}
+	// Over the gateway-wide budget, a tunnel makes room from its own entries; if that is
+	// not enough the new entry goes too (it is at the front, so it is evicted last).
+	for cacheTotalBytes.Load() > cacheTotalMaxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// account adds n bytes to this cache and the gateway-wide total; the caller holds c.mu.
+func (c *edgeCache) account(n int64) {
+	c.bytes += n
+	cacheTotalBytes.Add(n)
+}
+
+func sameVariant(a, b *cacheEntry) bool {
+	if strings.Join(a.vary, ",") != strings.Join(b.vary, ",") {
+		return false
+	}
+	for i := range a.varyValues {
+		if a.varyValues[i] != b.varyValues[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// remove drops el; the caller holds c.mu.
+func (c *edgeCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	c.account(-e.size())
+	variants := c.entries[e.key]
+	for i, v := range variants {
+		if v == el {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.entries, e.key)
+	} else {
+		c.entries[e.key] = variants
+	}
+}
+
+// purge drops entries whose path starts with prefix (everything for "") and returns
+// how many were removed.
+func (c *edgeCache) purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if strings.HasPrefix(el.Value.(*cacheEntry).key, prefix) {
+			c.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// release empties the cache of a disconnected tunnel, returning its bytes to the budget.
+func (c *edgeCache) release() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.purge("")
+}
+
+func (c *edgeCache) stats() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]int64{"entries": int64(c.lru.Len()), "bytes": c.bytes, "hits": c.hits.Load(), "misses": c.misses.Load()}
+}
+
+// cacheableRequest reports whether r may be answered from or stored in the cache.
+// Requests carrying credentials (Authorization or any cookie of the app's own) or asking
+// for a range go straight to the tunnel. The gateway's wormkey_* cookies do not count:
+// every viewer has them.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	for _, c := range r.Cookies() {
+		if !strings.HasPrefix(c.Name, "wormkey_") {
+			return false
+		}
+	}
+	return true
+}
+
+// requestNoCache reports whether the viewer asked for an end-to-end reload.
+func requestNoCache(r *http.Request) bool {
+	cc := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noCache := cc["no-cache"]
+	_, noStore := cc["no-store"]
+	return noCache || noStore || (r.Header.Get("Cache-Control") == "" && strings.Contains(r.Header.Get("Pragma"), "no-cache"))
+}
+
+func parseCacheControl(v string) map[string]string {
+	cc := map[string]string{}
+	for _, part := range strings.Split(v, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			cc[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+// responseTTL returns how long a response may be served without revalidation, and
+// whether it may be stored at all. Responses without explicit freshness are stored only
+// if they carry a validator, and are then revalidated on every use.
+func responseTTL(h http.Header, now time.Time) (time.Duration, bool) {
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := cc[d]; ok {
+			return 0, false
+		}
+	}
+	validator := h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+	if _, ok := cc["no-cache"]; ok {
+		return 0, validator
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return 0, validator
+			}
+			return time.Duration(secs)*time.Second - age(h), true
+		}
+	}
+	if exp := h.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil || !t.After(now) {
+			return 0, validator
+		}
+		if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			now = date
+		}
+		return t.Sub(now), true
+	}
+	return 0, validator
+}
+
+func age(h http.Header) time.Duration {
+	secs, _ := strconv.Atoi(h.Get("Age"))
+	return time.Duration(secs) * time.Second
+}
+
+// varyNames returns the request headers a response varies on, or false for Vary: *.
+// Encoded bodies always vary on Accept-Encoding, whether or not the app says so.
+func varyNames(h http.Header) ([]string, bool) {
+	var names []string
+	seen := map[string]bool{}
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if h.Get("Content-Encoding") != "" && !seen["Accept-Encoding"] {
+		names = append(names, "Accept-Encoding")
+	}
+	return names, true
+}
+
+// cacheFill collects a response from the tunnel for the cache. If stale is set the request
+// was sent as a revalidation of it; a 304 then marks it revalidated instead of reaching w.
+type cacheFill struct {
+	cache       *edgeCache
+	req         *http.Request
+	stale       *cacheEntry
+	entry       *cacheEntry
+	body        bytes.Buffer
+	revalidated *cacheEntry
+}
+
+// revalidation returns the request to forward: r itself, or a copy carrying the stale
+// entry's validators in place of the viewer's own conditional headers.
+func (f *cacheFill) revalidation(r *http.Request) *http.Request {
+	if f.stale == nil {
+		return r
+	}
+	etag, modified := f.stale.header.Get("ETag"), f.stale.header.Get("Last-Modified")
+	if etag == "" && modified == "" {
+		f.stale = nil
+		return r
+	}
+	fr := r.Clone(r.Context())
+	for _, k := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		fr.Header.Del(k)
+	}
+	if etag != "" {
+		fr.Header.Set("If-None-Match", etag)
+	}
+	if modified != "" {
+		fr.Header.Set("If-Modified-Since", modified)
+	}
+	return fr
+}
+
+// headers sees the app's response headers (before the gateway adds its own) and reports
+// whether the response should be withheld from the viewer because it revalidated the
+// stale entry. Called from the tunnel read loop with the stream locked.
+func (f *cacheFill) headers(status int, h http.Header) bool {
+	now := time.Now()
+	if status == http.StatusNotModified && f.stale != nil {
+		refreshed := *f.stale
+		refreshed.header = f.stale.header.Clone()
+		refreshed.header.Del("Age")
+		for _, k := range []string{"Age", "Cache-Control", "Date", "Expires", "ETag", "Last-Modified", "Vary"} {
+			if v := h.Values(k); len(v) > 0 {
+				refreshed.header[k] = v
+			}
+		}
+		refreshed.storedAt = now
+		refreshed.ttl, _ = responseTTL(refreshed.header, now)
+		f.revalidated = &refreshed
+		f.cache.store(&refreshed)
+		return true
+	}
+	if status != http.StatusOK || f.req.Method != http.MethodGet || isStreamingResponse(h) || h.Get("Set-Cookie") != "" || h.Get("Trailer") != "" {
+		return false
+	}
+	if cl, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && cl > cacheMaxEntryBytes {
+		return false
+	}
+	ttl, ok := responseTTL(h, now)
+	if !ok {
+		return false
+	}
+	vary, ok := varyNames(h)
+	if !ok {
+		return false
+	}
+	values := make([]string, len(vary))
+	for i, name := range vary {
+		values[i] = strings.Join(f.req.Header.Values(name), ", ")
+	}
+	f.entry = &cacheEntry{key: cacheKey(f.req), vary: vary, varyValues: values, status: status, header: h.Clone(), storedAt: now, ttl: ttl}
+	return false
+}
+
+func (f *cacheFill) write(p []byte) {
+	if f.entry == nil {
+		return
+	}
+	if int64(f.body.Len()+len(p)) > cacheMaxEntryBytes {
+		f.entry = nil
+		f.body = bytes.Buffer{}
+		return
+	}
+	f.body.Write(p)
+}
+
+// abandon stops collecting, e.g. when the response has trailers.
+func (f *cacheFill) abandon() { f.entry = nil }
+
+// finish stores the collected response once the stream ended normally.
+func (f *cacheFill) finish(complete bool) {
+	if !complete || f.entry == nil {
+		return
+	}
+	f.entry.body = f.body.Bytes()
+	f.cache.store(f.entry)
+}
+
+// serveCached writes e to the viewer, answering the viewer's own conditional headers.
+func serveCached(w http.ResponseWriter, r *http.Request, e *cacheEntry, status, setCookieSlug string) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = v
+	}
+	h.Set("Age", strconv.Itoa(int((age(e.header) + time.Since(e.storedAt)).Seconds())))
+	h.Set(cacheStatusHeader, status)
+	if setCookieSlug != "" {
+		h.Add("Set-Cookie", "wormkey_slug="+setCookieSlug+"; Path=/; SameSite=Lax")
+	}
+	if notModified(r, e.header) {
+		for _, k := range []string{"Content-Length", "Content-Type", "Content-Encoding"} {
+			h.Del(k)
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// notModified evaluates If-None-Match (weak comparison) or, failing that,
+// If-Modified-Since against the cached validators.
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
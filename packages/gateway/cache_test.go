@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseTTL(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	date := func(d time.Duration) string { return now.Add(d).Format(http.TimeFormat) }
+	tests := []struct {
+		name     string
+		header   map[string]string
+		ttl      time.Duration
+		storable bool
+	}{
+		{"nothing", nil, 0, false},
+		{"validator only", map[string]string{"ETag": `"v1"`}, 0, true},
+		{"last-modified only", map[string]string{"Last-Modified": date(-time.Hour)}, 0, true},
+		{"max-age", map[string]string{"Cache-Control": "public, max-age=60"}, time.Minute, true},
+		{"s-maxage wins", map[string]string{"Cache-Control": "max-age=60, s-maxage=30"}, 30 * time.Second, true},
+		{"s-maxage without max-age", map[string]string{"Cache-Control": "s-maxage=120"}, 2 * time.Minute, true},
+		{"age counts", map[string]string{"Cache-Control": "max-age=60", "Age": "20"}, 40 * time.Second, true},
+		{"age counts for s-maxage", map[string]string{"Cache-Control": "s-maxage=60", "Age": "45"}, 15 * time.Second, true},
+		{"max-age zero", map[string]string{"Cache-Control": "max-age=0"}, 0, false},
+		{"max-age zero with validator", map[string]string{"Cache-Control": "max-age=0", "ETag": `"v1"`}, 0, true},
+		{"bad max-age", map[string]string{"Cache-Control": "max-age=soon", "ETag": `"v1"`}, 0, true},
+		{"max-age over expires", map[string]string{"Cache-Control": "max-age=60", "Expires": date(time.Hour)}, time.Minute, true},
+		{"expires", map[string]string{"Expires": date(10 * time.Minute)}, 10 * time.Minute, true},
+		{"expires from date", map[string]string{"Expires": date(10 * time.Minute), "Date": date(-5 * time.Minute)}, 15 * time.Minute, true},
+		{"expired", map[string]string{"Expires": date(-time.Minute)}, 0, false},
+		{"expired with validator", map[string]string{"Expires": date(-time.Minute), "ETag": `"v1"`}, 0, true},
+		{"expires invalid", map[string]string{"Expires": "0"}, 0, false},
+		{"no-store", map[string]string{"Cache-Control": "no-store, max-age=60"}, 0, false},
+		{"private", map[string]string{"Cache-Control": "private, max-age=60", "ETag": `"v1"`}, 0, false},
+		{"no-cache", map[string]string{"Cache-Control": "no-cache, max-age=60", "ETag": `"v1"`}, 0, true},
+		{"no-cache without validator", map[string]string{"Cache-Control": "no-cache"}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.header {
+				h.Set(k, v)
+			}
+			ttl, storable := responseTTL(h, now)
+			if ttl != tt.ttl || storable != tt.storable {
+				t.Errorf("responseTTL = %v, %v; want %v, %v", ttl, storable, tt.ttl, tt.storable)
+			}
+		})
+	}
+}
+
+func TestCacheableRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		want   bool
+	}{
+		{"get", http.MethodGet, nil, true},
+		{"head", http.MethodHead, nil, true},
+		{"post", http.MethodPost, nil, false},
+		{"authorization", http.MethodGet, map[string]string{"Authorization": "Bearer t"}, false},
+		{"range", http.MethodGet, map[string]string{"Range": "bytes=0-99"}, false},
+		{"upgrade", http.MethodGet, map[string]string{"Upgrade": "websocket"}, false},
+		{"gateway cookies", http.MethodGet, map[string]string{"Cookie": "wormkey_viewer=v; wormkey_slug=demo"}, true},
+		{"app cookie", http.MethodGet, map[string]string{"Cookie": "session=s"}, false},
+		{"app and gateway cookies", http.MethodGet, map[string]string{"Cookie": "wormkey_viewer=v; session=s"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/page", nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if got := cacheableRequest(r); got != tt.want {
+				t.Errorf("cacheableRequest = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheBudget(t *testing.T) {
+	defer func(tunnel, total int64) { cacheMaxBytes, cacheTotalMaxBytes = tunnel, total }(cacheMaxBytes, cacheTotalMaxBytes)
+	entry := func(key string) *cacheEntry { return &cacheEntry{key: key, body: make([]byte, 1000)} }
+	size := entry("/0").size()
+	cacheMaxBytes, cacheTotalMaxBytes = 3*size, 4*size
+	base := cacheTotalBytes.Load()
+
+	a, b := newEdgeCache(), newEdgeCache()
+	for _, k := range []string{"/1", "/2", "/3", "/4"} {
+		a.store(entry(k))
+	}
+	if a.bytes != 3*size {
+		t.Errorf("tunnel a holds %d bytes, want its limit %d", a.bytes, 3*size)
+	}
+	b.store(entry("/1"))
+	b.store(entry("/2"))
+	if got := cacheTotalBytes.Load() - base; got > cacheTotalMaxBytes {
+		t.Errorf("total %d bytes, over the budget %d", got, cacheTotalMaxBytes)
+	}
+	if b.lru.Len() != 1 {
+		t.Errorf("tunnel b has %d entries with room for one in the budget", b.lru.Len())
+	}
+	a.release()
+	b.store(entry("/3"))
+	if b.lru.Len() != 2 {
+		t.Errorf("tunnel b has %d entries after a released its cache, want 2", b.lru.Len())
+	}
+	a.store(entry("/5"))
+	if a.lru.Len() != 0 {
+		t.Error("a released cache stored an entry")
+	}
+	b.release()
+	if got := cacheTotalBytes.Load(); got != base {
+		t.Errorf("total %d bytes after releasing both caches, want %d", got, base)
+	}
+}
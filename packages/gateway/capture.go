@@ -0,0 +1,442 @@
+// Offline webhook capture: while a known session has no tunnel connected, accept requests
+// with a canned response, persist them, and deliver them in order when the tunnel reconnects.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	captureMaxBody       = 1 << 20 // larger requests are rejected with 413 rather than stored
+	captureMaxPerSession = 1000
+	capturePolicyTTL     = 30 * time.Second // how long a control plane lookup for an offline slug is cached
+	capturePolicyMax     = 10000            // cached offline policies, including unknown slugs
+	captureSweepInterval = 10 * time.Minute // how often queues of expired sessions are removed
+	// capturePolicyLookups caps control plane lookups per second for uncached offline slugs,
+	// so requests for random slugs cannot turn into a flood of session fetches.
+	capturePolicyLookups = 20
+)
+
+// capturePolicy is the opt-in part of tunnelPolicy for offline capture.
+type capturePolicy struct {
+	Enabled     bool   `json:"enabled"`
+	Status      int    `json:"status,omitempty"`      // canned response status (default 202)
+	Body        string `json:"body,omitempty"`        // canned response body
+	ContentType string `json:"contentType,omitempty"` // canned response content type
+}
+
+func (cp *capturePolicy) writeCanned(w http.ResponseWriter) {
+	status, body, ct := cp.Status, cp.Body, cp.ContentType
+	if status == 0 {
+		status = http.StatusAccepted
+	}
+	if body == "" && ct == "" {
+		body, ct = `{"ok":true,"queued":true}`, "application/json"
+	}
+	if ct == "" {
+		ct = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("X-Wormkey-Captured", "true")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, body)
+}
+
+type capturedRequest struct {
+	ID         string      `json:"id"`
+	ReceivedAt string      `json:"receivedAt"`
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Headers    http.Header `json:"headers"`
+	Body       []byte      `json:"body"`
+}
+
+type cachedPolicy struct {
+	policy  *tunnelPolicy // nil when the slug is unknown, closed or expired
+	session sessionRef
+	expires time.Time
+}
+
+// captureStore persists captured requests as one JSONL file per session, named
+// <session id>.<expiry unix time>.jsonl so expired queues can be removed without asking
+// the control plane. A later session on the same slug never sees an earlier one's queue.
+type captureStore struct {
+	dir             string
+	controlPlaneURL string
+	mu              sync.Mutex
+	queueLocks      map[string]*sync.Mutex
+	counts          map[string]int // queued requests per session, read from disk on first use
+	policies        map[string]cachedPolicy
+	lookupWindow    time.Time
+	lookups         int
+}
+
+func newCaptureStore(dir, controlPlaneURL string) *captureStore {
+	return &captureStore{
+		dir:             dir,
+		controlPlaneURL: controlPlaneURL,
+		queueLocks:      map[string]*sync.Mutex{},
+		counts:          map[string]int{},
+		policies:        map[string]cachedPolicy{},
+	}
+}
+
+var safeSlug = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func (cs *captureStore) lock(session sessionRef) *sync.Mutex {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	l, ok := cs.queueLocks[session.ID]
+	if !ok {
+		l = &sync.Mutex{}
+		cs.queueLocks[session.ID] = l
+	}
+	return l
+}
+
+func (cs *captureStore) path(session sessionRef) string {
+	var expires int64
+	if !session.Expires.IsZero() {
+		expires = session.Expires.Unix()
+	}
+	return filepath.Join(cs.dir, session.ID+"."+strconv.FormatInt(expires, 10)+".jsonl")
+}
+
+// remember caches the policy of a tunnel that just disconnected, so capture starts (and
+// the owner's error pages show) immediately without a control plane round trip.
+func (cs *captureStore) remember(slug string, session sessionRef, policy tunnelPolicy) {
+	cs.storePolicy(slug, session, &policy)
+}
+
+// forget drops any cached policy and queued requests when the owner closes the session.
+func (cs *captureStore) forget(slug string, session sessionRef) {
+	cs.storePolicy(slug, sessionRef{}, nil)
+	cs.drop(session)
+}
+
+// drop deletes the queue of a session that has ended.
+func (cs *captureStore) drop(session sessionRef) {
+	if !safeSlug.MatchString(session.ID) {
+		return
+	}
+	l := cs.lock(session)
+	l.Lock()
+	err := cs.rewrite(session, nil)
+	l.Unlock()
+	if err != nil {
+		log.Printf("capture: remove queue of %s: %v", session.ID, err)
+	}
+	cs.mu.Lock()
+	delete(cs.queueLocks, session.ID)
+	cs.mu.Unlock()
+}
+
+// storePolicy caches policy for slug, never past the session's expiry. When the cache is
+// full it drops expired entries first, then the one closest to expiry.
+func (cs *captureStore) storePolicy(slug string, session sessionRef, policy *tunnelPolicy) {
+	now := time.Now()
+	expires := now.Add(capturePolicyTTL)
+	if policy != nil && !session.Expires.IsZero() && session.Expires.Before(expires) {
+		expires = session.Expires
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.policies[slug]; !ok && len(cs.policies) >= capturePolicyMax {
+		oldest := ""
+		for s, cached := range cs.policies {
+			if now.After(cached.expires) {
+				delete(cs.policies, s)
+			} else if oldest == "" || cached.expires.Before(cs.policies[oldest].expires) {
+				oldest = s
+			}
+		}
+		if len(cs.policies) >= capturePolicyMax {
+			delete(cs.policies, oldest)
+		}
+	}
+	cs.policies[slug] = cachedPolicy{policy: policy, session: session, expires: expires}
+}
+
+// allowLookup reports whether an uncached slug may be looked up now (capturePolicyLookups
+// per second across all slugs).
+func (cs *captureStore) allowLookup() bool {
+	now := time.Now()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if now.Sub(cs.lookupWindow) >= time.Second {
+		cs.lookupWindow, cs.lookups = now, 0
+	}
+	if cs.lookups >= capturePolicyLookups {
+		return false
+	}
+	cs.lookups++
+	return true
+}
+
+// offlinePolicy returns the policy and session of an open, unexpired session with no
+// tunnel connected, or nil.
+func (cs *captureStore) offlinePolicy(slug string) (*tunnelPolicy, sessionRef) {
+	if !safeSlug.MatchString(slug) {
+		return nil, sessionRef{}
+	}
+	cs.mu.Lock()
+	cached, ok := cs.policies[slug]
+	cs.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.policy, cached.session
+	}
+	if !cs.allowLookup() {
+		// Over the lookup budget: answer as unknown without caching, so the slug is
+		// looked up normally once the burst is over.
+		return nil, sessionRef{}
+	}
+	var policy *tunnelPolicy
+	var session sessionRef
+	if sess, status, err := fetchSession(cs.controlPlaneURL, slug); err == nil && status == http.StatusOK {
+		if !sess.Closed && !sess.ref().expired(time.Now()) {
+			policy, session = &sess.Policy, sess.ref()
+		} else {
+			go cs.drop(sess.ref()) // closed or expired while the tunnel was away
+		}
+	}
+	cs.storePolicy(slug, session, policy)
+	return policy, session
+}
+
+// count returns the number of queued requests for session, reading the file only the
+// first time. Callers hold the queue lock.
+func (cs *captureStore) count(session sessionRef) int {
+	cs.mu.Lock()
+	n, ok := cs.counts[session.ID]
+	cs.mu.Unlock()
+	if ok {
+		return n
+	}
+	if f, err := os.Open(cs.path(session)); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 4*captureMaxBody)
+		for sc.Scan() {
+			n++
+		}
+		f.Close()
+	}
+	cs.setCount(session, n)
+	return n
+}
+
+// setCount records the queue length for session; 0 drops the entry, so a count left
+// unknown by a failed write is read from disk again.
+func (cs *captureStore) setCount(session sessionRef, n int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if n == 0 {
+		delete(cs.counts, session.ID)
+		return
+	}
+	cs.counts[session.ID] = n
+}
+
+var errCaptureFull = errors.New("capture queue full")
+
+// append durably stores req (fsync before returning).
+func (cs *captureStore) append(session sessionRef, req capturedRequest) error {
+	l := cs.lock(session)
+	l.Lock()
+	defer l.Unlock()
+	n := cs.count(session)
+	if n >= captureMaxPerSession {
+		return errCaptureFull
+	}
+	if err := os.MkdirAll(cs.dir, 0o700); err != nil {
+		return err
+	}
+	line, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(cs.path(session), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		cs.setCount(session, 0)
+		return err
+	}
+	cs.setCount(session, n+1)
+	return nil
+}
+
+func (cs *captureStore) load(session sessionRef) ([]capturedRequest, error) {
+	f, err := os.Open(cs.path(session))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []capturedRequest
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4*captureMaxBody)
+	for sc.Scan() {
+		var req capturedRequest
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			log.Printf("capture: skipping corrupt entry for %s: %v", session.ID, err)
+			continue
+		}
+		out = append(out, req)
+	}
+	return out, sc.Err()
+}
+
+// rewrite atomically replaces the stored queue with remaining (removing the file when empty).
+func (cs *captureStore) rewrite(session sessionRef, remaining []capturedRequest) error {
+	cs.setCount(session, 0)
+	if len(remaining) == 0 {
+		err := os.Remove(cs.path(session))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var buf bytes.Buffer
+	for _, req := range remaining {
+		line, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmp := cs.path(session) + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, cs.path(session)); err != nil {
+		return err
+	}
+	cs.setCount(session, len(remaining))
+	return nil
+}
+
+// capture stores r for later delivery to session and writes the canned response. Returns
+// false if the request could not be stored (the caller falls back to the not-active page).
+func (cs *captureStore) capture(w http.ResponseWriter, r *http.Request, session sessionRef, cp *capturePolicy, requestID string) bool {
+	if !safeSlug.MatchString(session.ID) {
+		return false // the control plane did not say which session this is
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, captureMaxBody+1))
+	r.Body.Close()
+	if err != nil {
+		return false
+	}
+	if len(body) > captureMaxBody {
+		metrics.captures.Inc("too_large")
+		http.Error(w, "Request body too large to queue", http.StatusRequestEntityTooLarge)
+		return true
+	}
+	req := capturedRequest{
+		ID:         requestID,
+		ReceivedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+		Headers:    r.Header.Clone(),
+		Body:       body,
+	}
+	if err := cs.append(session, req); err != nil {
+		metrics.captures.Inc("store_failed")
+		log.Printf("capture: %s: %v", session.ID, err)
+		return false
+	}
+	metrics.captures.Inc("captured")
+	cp.writeCanned(w)
+	return true
+}
+
+// deliver replays the stored queue of tc's session in arrival order. Stops at the first
+// tunnel failure or 5xx response and keeps that request and the rest on disk.
+func (cs *captureStore) deliver(tc *tunnelConn) {
+	if !safeSlug.MatchString(tc.session.ID) {
+		return
+	}
+	l := cs.lock(tc.session)
+	l.Lock()
+	defer l.Unlock()
+	queued, err := cs.load(tc.session)
+	if err != nil {
+		log.Printf("capture: load %s: %v", tc.slug, err)
+		return
+	}
+	if len(queued) == 0 {
+		return
+	}
+	log.Printf("capture: delivering %d queued request(s) to %s", len(queued), tc.slug)
+	delivered := 0
+	for _, q := range queued {
+		req, err := http.NewRequest(q.Method, q.Path, bytes.NewReader(q.Body))
+		if err != nil {
+			delivered++ // unreplayable; drop it
+			continue
+		}
+		req.Header = q.Headers.Clone()
+		req.Header.Set("X-Wormkey-Captured-At", q.ReceivedAt)
+		req.Header.Set(requestIDHeader, q.ID)
+		rec, err := tc.forwardBuffered(context.Background(), req, q.Body)
+		if err != nil {
+			log.Printf("capture: delivery to %s interrupted: %v", tc.slug, err)
+			break
+		}
+		rec.ID = q.ID
+		rec.CapturedAt = q.ReceivedAt
+		tc.inspector.record(rec)
+		if rec.Status >= 500 {
+			// The app (or the CLI reaching it) failed; retry on the next connect.
+			metrics.captures.Inc("delivery_failed")
+			log.Printf("capture: delivery to %s got %d, keeping %d request(s) queued", tc.slug, rec.Status, len(queued)-delivered)
+			break
+		}
+		metrics.captures.Inc("delivered")
+		delivered++
+	}
+	if err := cs.rewrite(tc.session, queued[delivered:]); err != nil {
+		log.Printf("capture: rewrite %s: %v", tc.slug, err)
+	}
+}
+
+// sweepExpired removes the queues of expired sessions every captureSweepInterval.
+func (cs *captureStore) sweepExpired() {
+	for range time.Tick(captureSweepInterval) {
+		paths, _ := filepath.Glob(filepath.Join(cs.dir, "*.jsonl"))
+		now := time.Now()
+		for _, p := range paths {
+			id, expires, ok := strings.Cut(strings.TrimSuffix(filepath.Base(p), ".jsonl"), ".")
+			unix, err := strconv.ParseInt(expires, 10, 64)
+			if !ok || err != nil || unix == 0 {
+				continue
+			}
+			if session := (sessionRef{ID: id, Expires: time.Unix(unix, 0)}); session.expired(now) {
+				cs.drop(session)
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Tunnel compression. permessage-deflate is negotiated on the tunnel WebSocket (unless
+// WORMKEY_TUNNEL_COMPRESSION=off) and each side decides per message whether to use it:
+// only STREAM_DATA frames of bodies that are not already compressed go through
+// writeCompressible, so images, archives and encoded responses do not pay for a second
+// pass. Headers are always sent raw, since they carry cookies and tokens that must not
+// share a deflate context with bodies. Raw TCP/UDP data is sent as is.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// minCompressSize matches the ws library's default threshold; smaller messages are not
+// worth deflating.
+const minCompressSize = 1024
+
+// precompressedTypes are content types whose bodies are usually compressed already.
+var precompressedTypes = []string{
+	"image/", "video/", "audio/", "font/woff", "application/octet-stream", "application/pdf",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/x-bzip2", "application/x-xz",
+}
+
+// compressibleBody reports whether a body with headers h should be deflated on the tunnel.
+func compressibleBody(h http.Header) bool {
+	for _, k := range []string{"Content-Encoding", "Grpc-Encoding"} {
+		if v := strings.ToLower(strings.TrimSpace(h.Get(k))); v != "" && v != "identity" {
+			return false
+		}
+	}
+	ct := strings.ToLower(h.Get("Content-Type"))
+	if strings.HasPrefix(ct, "image/svg+xml") {
+		return true
+	}
+	for _, t := range precompressedTypes {
+		if strings.HasPrefix(ct, t) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+// Content-Security-Policy handling for the owner overlay. The overlay is an external
+// same-origin script that fetches /.wormkey/* endpoints, so a response's CSP has to allow
+// it in script-src and connect-src. Policies that do not are rewritten for the owner's
+// response only; the result of the last injection is reported in /.wormkey/state.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// overlayReport describes what happened to the overlay on the owner's last HTML page.
+type overlayReport struct {
+	Injected bool   `json:"injected"`
+	Path     string `json:"path"`
+	CSP      string `json:"csp,omitempty"`    // "updated" when the policy was changed to allow the overlay
+	Reason   string `json:"reason,omitempty"` // why the overlay was not injected
+	At       string `json:"at"`
+}
+
+// reportOverlay records the outcome for the tunnel's latest owner HTML page. The report
+// lives on the tunnel connection, so it goes away with the tunnel.
+func (tc *tunnelConn) reportOverlay(path string, injected bool, csp, reason string) {
+	tc.overlay.Store(&overlayReport{Injected: injected, Path: path, CSP: csp, Reason: reason, At: time.Now().UTC().Format(time.RFC3339)})
+}
+
+type cspDirective struct {
+	name    string
+	sources []string
+}
+
+func (d *cspDirective) has(source string) bool {
+	for _, s := range d.sources {
+		if strings.EqualFold(s, source) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *cspDirective) hasPrefix(prefix string) bool {
+	for _, s := range d.sources {
+		if strings.HasPrefix(strings.ToLower(s), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// add appends a source, dropping 'none' (which only stands alone).
+func (d *cspDirective) add(source string) {
+	kept := d.sources[:0]
+	for _, s := range d.sources {
+		if !strings.EqualFold(s, "'none'") {
+			kept = append(kept, s)
+		}
+	}
+	d.sources = append(kept, source)
+}
+
+type cspPolicy []*cspDirective
+
+func parseCSPPolicy(policy string) cspPolicy {
+	var p cspPolicy
+	for _, part := range strings.Split(policy, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		if p.get(name) != nil {
+			continue // only the first occurrence of a directive counts
+		}
+		p = append(p, &cspDirective{name: name, sources: fields[1:]})
+	}
+	return p
+}
+
+func (p cspPolicy) get(name string) *cspDirective {
+	for _, d := range p {
+		if d.name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// effective returns the first directive present, following the CSP fallback list.
+func (p cspPolicy) effective(names ...string) *cspDirective {
+	for _, n := range names {
+		if d := p.get(n); d != nil {
+			return d
+		}
+	}
+	return nil
+}
+
+// override returns the directive called name, creating it from fallback's sources so it
+// can be changed without touching the fallback (usually default-src).
+func (p *cspPolicy) override(name string, d *cspDirective) *cspDirective {
+	if d.name == name {
+		return d
+	}
+	nd := &cspDirective{name: name, sources: append([]string(nil), d.sources...)}
+	*p = append(*p, nd)
+	return nd
+}
+
+func (p cspPolicy) String() string {
+	parts := make([]string, len(p))
+	for i, d := range p {
+		parts[i] = strings.Join(append([]string{d.name}, d.sources...), " ")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// allowsSameOrigin reports whether d allows a URL on the page's own origin.
+func (d *cspDirective) allowsSameOrigin(host string, https bool) bool {
+	scheme := "http:"
+	if https {
+		scheme = "https:"
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	hostname = strings.ToLower(hostname)
+	for _, s := range d.sources {
+		s = strings.ToLower(s)
+		switch {
+		case s == "*" || s == "'self'" || s == scheme || (s == "http:" && https):
+			return true
+		case strings.HasPrefix(s, "'") || strings.HasSuffix(s, ":"):
+			continue // other keywords and schemes
+		}
+		if i := strings.Index(s, "://"); i >= 0 {
+			if s[:i+1] != scheme && !(s[:i+1] == "http:" && https) {
+				continue
+			}
+			s = s[i+3:]
+		}
+		if i := strings.IndexByte(s, '/'); i >= 0 {
+			if s[i:] != "/" {
+				continue // path-restricted sources do not cover /.wormkey/
+			}
+			s = s[:i]
+		}
+		if h, _, err := net.SplitHostPort(s); err == nil {
+			s = h
+		}
+		if s == hostname || (strings.HasPrefix(s, "*.") && strings.HasSuffix(hostname, s[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// fitOverlayCSP rewrites the response's Content-Security-Policy headers so the overlay tag
+// carrying nonce can load and reach /.wormkey/. Scripts get the nonce, except where the
+// directive relies on 'unsafe-inline' (a nonce would switch that off), which gets 'self'.
+// It returns whether a policy changed, or a reason when the overlay cannot run at all.
+func fitOverlayCSP(h http.Header, host string, https bool, nonce string) (changed bool, reason string) {
+	values := h.Values("Content-Security-Policy")
+	if len(values) == 0 {
+		return false, ""
+	}
+	out := make([]string, 0, len(values))
+	for _, value := range values {
+		var policies []string
+		for _, raw := range strings.Split(value, ",") {
+			p := parseCSPPolicy(raw)
+			if len(p) == 0 {
+				continue
+			}
+			if sb := p.get("sandbox"); sb != nil && !sb.has("allow-scripts") {
+				return false, "CSP sandbox does not allow scripts"
+			}
+			if p.get("require-trusted-types-for") != nil {
+				return false, "CSP requires Trusted Types"
+			}
+			if d := p.effective("script-src-elem", "script-src", "default-src"); d != nil && !d.has("'nonce-"+nonce+"'") {
+				strict := d.has("'strict-dynamic'")
+				if strict || !d.allowsSameOrigin(host, https) {
+					name := d.name
+					if name == "default-src" {
+						name = "script-src"
+					}
+					d = p.override(name, d)
+					if d.has("'unsafe-inline'") && !strict && !d.hasPrefix("'nonce-") && !d.hasPrefix("'sha") {
+						d.add("'self'")
+					} else {
+						d.add("'nonce-" + nonce + "'")
+					}
+					changed = true
+				}
+			}
+			if d := p.effective("connect-src", "default-src"); d != nil && !d.allowsSameOrigin(host, https) {
+				d = p.override("connect-src", d)
+				d.add("'self'")
+				changed = true
+			}
+			policies = append(policies, p.String())
+		}
+		out = append(out, strings.Join(policies, ", "))
+	}
+	if changed {
+		h["Content-Security-Policy"] = out
+	}
+	return changed, ""
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFitOverlayCSP(t *testing.T) {
+	const host, nonce = "demo.wormkey.run", "abc"
+	tests := []struct {
+		name   string
+		csp    []string
+		https  bool
+		want   []string // nil: header left alone
+		reason string
+	}{
+		{name: "no policy"},
+		{
+			name: "default-src self",
+			csp:  []string{"default-src 'self'"},
+		},
+		{
+			name: "default-src none",
+			csp:  []string{"default-src 'none'"},
+			want: []string{"default-src 'none'; script-src 'nonce-abc'; connect-src 'self'"},
+		},
+		{
+			name: "default-src other host",
+			csp:  []string{"default-src https://cdn.example.com; img-src *"},
+			want: []string{"default-src https://cdn.example.com; img-src *; script-src https://cdn.example.com 'nonce-abc'; connect-src https://cdn.example.com 'self'"},
+		},
+		{
+			name:  "own host by scheme",
+			csp:   []string{"default-src https:"},
+			https: true,
+		},
+		{
+			name: "own host needs https",
+			csp:  []string{"script-src https://demo.wormkey.run; connect-src 'self'"},
+			want: []string{"script-src https://demo.wormkey.run 'nonce-abc'; connect-src 'self'"},
+		},
+		{
+			name:  "wildcard host",
+			csp:   []string{"script-src https://*.wormkey.run; connect-src 'self'"},
+			https: true,
+		},
+		{
+			name: "strict-dynamic ignores self",
+			csp:  []string{"script-src 'strict-dynamic' 'nonce-xyz' 'self'; connect-src 'self'"},
+			want: []string{"script-src 'strict-dynamic' 'nonce-xyz' 'self' 'nonce-abc'; connect-src 'self'"},
+		},
+		{
+			name: "strict-dynamic with unsafe-inline",
+			csp:  []string{"script-src 'strict-dynamic' 'unsafe-inline'; connect-src 'self'"},
+			want: []string{"script-src 'strict-dynamic' 'unsafe-inline' 'nonce-abc'; connect-src 'self'"},
+		},
+		{
+			name: "unsafe-inline keeps working",
+			csp:  []string{"script-src 'unsafe-inline' https://cdn.example.com; connect-src 'self'"},
+			want: []string{"script-src 'unsafe-inline' https://cdn.example.com 'self'; connect-src 'self'"},
+		},
+		{
+			name: "unsafe-inline already off",
+			csp:  []string{"script-src 'unsafe-inline' 'nonce-xyz'; connect-src 'self'"},
+			want: []string{"script-src 'unsafe-inline' 'nonce-xyz' 'nonce-abc'; connect-src 'self'"},
+		},
+		{
+			name: "script-src-elem wins",
+			csp:  []string{"script-src 'self'; script-src-elem 'none'; connect-src 'self'"},
+			want: []string{"script-src 'self'; script-src-elem 'nonce-abc'; connect-src 'self'"},
+		},
+		{
+			name: "nonce already allowed",
+			csp:  []string{"script-src 'nonce-abc'; connect-src 'self'"},
+		},
+		{
+			name: "every policy applies",
+			csp:  []string{"default-src 'self'", "script-src 'none'"},
+			want: []string{"default-src 'self'", "script-src 'nonce-abc'"},
+		},
+		{
+			name:   "sandbox without scripts",
+			csp:    []string{"sandbox allow-forms"},
+			reason: "CSP sandbox does not allow scripts",
+		},
+		{
+			name:   "trusted types",
+			csp:    []string{"require-trusted-types-for 'script'"},
+			reason: "CSP requires Trusted Types",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for _, v := range tt.csp {
+				h.Add("Content-Security-Policy", v)
+			}
+			changed, reason := fitOverlayCSP(h, host, tt.https, nonce)
+			if reason != tt.reason {
+				t.Errorf("reason = %q, want %q", reason, tt.reason)
+			}
+			if changed != (tt.want != nil) {
+				t.Errorf("changed = %v, want %v", changed, tt.want != nil)
+			}
+			want := tt.want
+			if want == nil {
+				want = tt.csp
+			}
+			got := h.Values("Content-Security-Policy")
+			if len(got) != len(want) {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Errorf("policy %d: got %q, want %q", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,434 @@
+// Custom domains: owners map their own hostnames to a slug after proving control of the
+// name with a DNS TXT record or an HTTP file served from the host's current server. A
+// domain belongs to the session that added it and stops routing when that session ends;
+// on a reserved slug it passes to the next session of the reserving account.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	domainTXTPrefix     = "_wormkey-challenge."
+	domainHTTPChallenge = "/.well-known/wormkey-challenge/"
+	domainPruneInterval = 10 * time.Minute // how often domains of expired sessions are removed
+)
+
+type customDomain struct {
+	Hostname   string `json:"hostname"`
+	Slug       string `json:"slug"`
+	SessionID  string `json:"sessionId"`
+	ExpiresAt  string `json:"expiresAt,omitempty"`
+	AccountID  string `json:"accountId,omitempty"` // set on reserved slugs
+	Token      string `json:"token"`
+	Verified   bool   `json:"verified"`
+	CreatedAt  string `json:"createdAt"`
+	VerifiedAt string `json:"verifiedAt,omitempty"`
+}
+
+// domainStore holds hostname -> custom domain, persisted to a JSON file.
+type domainStore struct {
+	path    string
+	mu      sync.RWMutex
+	domains map[string]*customDomain
+}
+
+// domains is consulted by extractSlugFromHost on every request.
+var domains = &domainStore{domains: map[string]*customDomain{}}
+
+var errDomainTaken = errors.New("hostname is already verified for another wormhole")
+
+func (d *customDomain) session() sessionRef {
+	expires, _ := time.Parse(time.RFC3339, d.ExpiresAt)
+	return sessionRef{ID: d.SessionID, Expires: expires}
+}
+
+func (d *customDomain) bind(session sessionRef) {
+	d.SessionID, d.ExpiresAt = session.ID, ""
+	if !session.Expires.IsZero() {
+		d.ExpiresAt = session.Expires.UTC().Format(time.RFC3339)
+	}
+}
+
+// live reports whether d routes traffic: verified, and its session has not expired.
+func (d *customDomain) live(now time.Time) bool {
+	return d.Verified && d.SessionID != "" && !d.session().expired(now)
+}
+
+var hostnamePattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// normalizeHostname lowercases host and strips any port and trailing dot.
+func normalizeHostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func (ds *domainStore) load(path string) error {
+	ds.path = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*customDomain
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for _, d := range list {
+		if d.SessionID == "" {
+			// Written before domains were bound to sessions; the owner adds it again.
+			log.Printf("domains: dropping %s, it is not bound to a session", d.Hostname)
+			continue
+		}
+		ds.domains[d.Hostname] = d
+	}
+	return nil
+}
+
+// save writes the store atomically. Callers hold ds.mu.
+func (ds *domainStore) save() {
+	if ds.path == "" {
+		return
+	}
+	list := make([]*customDomain, 0, len(ds.domains))
+	for _, d := range ds.domains {
+		list = append(list, d)
+	}
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(ds.path), 0o700)
+	}
+	if err == nil {
+		err = os.WriteFile(ds.path+".tmp", b, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(ds.path+".tmp", ds.path)
+	}
+	if err != nil {
+		log.Printf("domains: save %s: %v", ds.path, err)
+	}
+}
+
+// slugFor returns the slug of a live custom domain, or "".
+func (ds *domainStore) slugFor(host string) string {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	if d, ok := ds.domains[normalizeHostname(host)]; ok && d.live(time.Now()) {
+		return d.Slug
+	}
+	return ""
+}
+
+// verified reports whether host is a verified custom domain (used before issuing certificates).
+func (ds *domainStore) verified(host string) bool {
+	return ds.slugFor(host) != ""
+}
+
+// owned reports whether d was added (or adopted) by session on slug.
+func (d *customDomain) owned(slug string, session sessionRef) bool {
+	return d.Slug == slug && session.ID != "" && d.SessionID == session.ID
+}
+
+func (ds *domainStore) list(slug string, session sessionRef) []customDomain {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	out := []customDomain{}
+	for _, d := range ds.domains {
+		if d.owned(slug, session) {
+			out = append(out, *d)
+		}
+	}
+	return out
+}
+
+// add creates (or returns the existing) pending record for hostname under session.
+// account is the reserving account of slug, or "".
+func (ds *domainStore) add(slug string, session sessionRef, account, hostname string) (customDomain, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if d, ok := ds.domains[hostname]; ok {
+		if d.owned(slug, session) {
+			return *d, nil
+		}
+		if d.live(time.Now()) {
+			return customDomain{}, errDomainTaken
+		}
+	}
+	d := &customDomain{
+		Hostname:  hostname,
+		Slug:      slug,
+		AccountID: account,
+		Token:     randomSecret(16),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	d.bind(session)
+	ds.domains[hostname] = d
+	ds.save()
+	return *d, nil
+}
+
+func (ds *domainStore) markVerified(slug string, session sessionRef, hostname string) (customDomain, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	d, ok := ds.domains[hostname]
+	if !ok || !d.owned(slug, session) {
+		return customDomain{}, false
+	}
+	d.Verified = true
+	d.VerifiedAt = time.Now().UTC().Format(time.RFC3339)
+	ds.save()
+	return *d, true
+}
+
+func (ds *domainStore) get(slug string, session sessionRef, hostname string) (customDomain, bool) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	d, ok := ds.domains[hostname]
+	if !ok || !d.owned(slug, session) {
+		return customDomain{}, false
+	}
+	return *d, true
+}
+
+func (ds *domainStore) remove(slug string, session sessionRef, hostname string) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	d, ok := ds.domains[hostname]
+	if !ok || !d.owned(slug, session) {
+		return false
+	}
+	delete(ds.domains, hostname)
+	ds.save()
+	return true
+}
+
+// removeSlug drops every domain of a closed session.
+func (ds *domainStore) removeSlug(slug string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	changed := false
+	for host, d := range ds.domains {
+		if d.Slug == slug {
+			delete(ds.domains, host)
+			changed = true
+		}
+	}
+	if changed {
+		ds.save()
+	}
+}
+
+// adopt moves the domains of a reserved slug to a new session of the reserving account.
+func (ds *domainStore) adopt(slug string, session sessionRef, account string) {
+	if session.ID == "" || account == "" {
+		return
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	changed := false
+	for _, d := range ds.domains {
+		if d.Slug == slug && d.AccountID == account && d.SessionID != session.ID {
+			d.bind(session)
+			changed = true
+		}
+	}
+	if changed {
+		ds.save()
+	}
+}
+
+// pruneExpired removes domains whose session has expired every domainPruneInterval.
+// Domains of reserved slugs wait for the account's next session instead.
+func (ds *domainStore) pruneExpired() {
+	for range time.Tick(domainPruneInterval) {
+		now := time.Now()
+		ds.mu.Lock()
+		changed := false
+		for host, d := range ds.domains {
+			if d.AccountID == "" && d.session().expired(now) {
+				delete(ds.domains, host)
+				changed = true
+			}
+		}
+		if changed {
+			ds.save()
+		}
+		ds.mu.Unlock()
+	}
+}
+
+// domainVerifyClient fetches HTTP challenge files. Hostnames come from owners, so it does
+// not follow redirects and refuses to connect to loopback, private or link-local addresses
+// (checked on the resolved address at dial time, so DNS rebinding cannot get around it).
+var domainVerifyClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("refusing to connect to non-public address %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		DisableKeepAlives: true,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsUnspecified() && !ip.IsMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// verifyDomainOwnership checks the TXT record _wormkey-challenge.<host>, then
+// http://<host>/.well-known/wormkey-challenge/<token>. The gateway never answers that
+// path itself, so the HTTP method only passes when the host's current server serves it.
+func verifyDomainOwnership(ctx context.Context, d customDomain) error {
+	txts, dnsErr := net.DefaultResolver.LookupTXT(ctx, domainTXTPrefix+d.Hostname)
+	for _, txt := range txts {
+		if strings.TrimSpace(txt) == d.Token {
+			return nil
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+d.Hostname+domainHTTPChallenge+d.Token, nil)
+	if err != nil {
+		return err
+	}
+	resp, httpErr := domainVerifyClient.Do(req)
+	if httpErr == nil {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && strings.TrimSpace(string(body)) == d.Token {
+			return nil
+		}
+	}
+	if dnsErr == nil && len(txts) > 0 {
+		return errors.New("TXT record found but token does not match")
+	}
+	return errors.New("no matching TXT record or HTTP challenge file found")
+}
+
+// handleDomains serves the owner API:
+//
+//	GET    /.wormkey/domains                      list
+//	POST   /.wormkey/domains {"hostname"}         add (returns the challenge)
+//	POST   /.wormkey/domains/verify {"hostname"}  verify
+//	DELETE /.wormkey/domains?hostname=
+func handleDomains(tunnels *sync.Map) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := resolveSlug(r)
+		val, ok := tunnels.Load(slug)
+		if !ok {
+			http.Error(w, "Tunnel not connected", 503)
+			return
+		}
+		tc := val.(*tunnelConn)
+		if !isOwner(r, tc) {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		if r.Method != http.MethodGet && tc.session.ID == "" {
+			http.Error(w, "Control plane unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		hostname := normalizeHostname(r.URL.Query().Get("hostname"))
+		if r.Method == http.MethodPost {
+			var body struct {
+				Hostname string `json:"hostname"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid JSON", 400)
+				return
+			}
+			hostname = normalizeHostname(body.Hostname)
+		}
+		if r.Method != http.MethodGet && !hostnamePattern.MatchString(hostname) {
+			http.Error(w, "Invalid hostname", 400)
+			return
+		}
+		verify := strings.HasSuffix(r.URL.Path, "/verify")
+		var out any
+		switch {
+		case r.Method == http.MethodGet:
+			out = map[string]any{"domains": domains.list(slug, tc.session)}
+		case r.Method == http.MethodPost && !verify:
+			if underBaseDomain(hostname) {
+				http.Error(w, "Hostname is under the wormhole base domain", 400)
+				return
+			}
+			account, _ := reservedSlugs.Load(slug)
+			accountID, _ := account.(string)
+			d, err := domains.add(slug, tc.session, accountID, hostname)
+			if err != nil {
+				http.Error(w, err.Error(), 409)
+				return
+			}
+			out = map[string]any{"domain": d, "challenge": map[string]string{
+				"txtName":  domainTXTPrefix + d.Hostname,
+				"txtValue": d.Token,
+				"httpUrl":  "http://" + d.Hostname + domainHTTPChallenge + d.Token,
+				"httpBody": d.Token,
+			}}
+		case r.Method == http.MethodPost && verify:
+			d, ok := domains.get(slug, tc.session, hostname)
+			if !ok {
+				http.Error(w, "Unknown hostname", 404)
+				return
+			}
+			if !d.Verified {
+				ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+				err := verifyDomainOwnership(ctx, d)
+				cancel()
+				if err != nil {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(422)
+					_ = json.NewEncoder(w).Encode(map[string]any{"ok": false, "error": err.Error()})
+					return
+				}
+				d, _ = domains.markVerified(slug, tc.session, hostname)
+				log.Printf("domains: %s verified for %s", hostname, slug)
+			}
+			out = map[string]any{"ok": true, "domain": d}
+		case r.Method == http.MethodDelete:
+			if !domains.remove(slug, tc.session, hostname) {
+				http.Error(w, "Unknown hostname", 404)
+				return
+			}
+			out = map[string]any{"ok": true}
+		default:
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	}
+}
@@ -0,0 +1,262 @@
+// Error pages shown by the gateway itself (tunnel not active, locked, paused, ...). Owners
+// can brand them per tunnel with policy.errorPages: new copy for the default page, or a
+// whole page as an html/template. Viewers that accept JSON and not HTML get a JSON error.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const errorPageMaxHTML = 64 << 10
+
+// errorPage customises the page for one error kind.
+type errorPage struct {
+	Title   string `json:"title,omitempty"`   // replaces the default heading
+	Message string `json:"message,omitempty"` // replaces the default text (plain text)
+	HTML    string `json:"html,omitempty"`    // whole page, an html/template given errorPageData
+
+	tmpl *template.Template // HTML parsed by prepareErrorPages
+}
+
+// errorPageData is what an owner's template can use.
+type errorPageData struct {
+	Kind      string
+	Status    int
+	Title     string
+	Message   string
+	RequestID string
+}
+
+// errorPageWriters are the error kinds owners can brand, and preview at
+// /.wormkey/error-pages?kind=. "default" applies to any kind without its own page.
+var errorPageWriters = map[string]func(http.ResponseWriter){
+	"not_active":       writeWormholeNotActive,
+	"paused":           writeTunnelPaused,
+	"locked":           writeLockedByOwner,
+	"password":         writePasswordRequired,
+	"removed":          writeViewerRemoved,
+	"too_many_viewers": writeTooManyViewers,
+	"blocked_path":     writePathBlocked,
+	"connection_lost":  writeTunnelWriteFailed,
+}
+
+// prepareErrorPages checks kinds, sizes and templates before pages are stored, and parses
+// the templates so rendering an error page does not.
+func prepareErrorPages(pages map[string]errorPage) error {
+	for kind, page := range pages {
+		if _, ok := errorPageWriters[kind]; !ok && kind != "default" {
+			return fmt.Errorf("unknown error page kind %q", kind)
+		}
+		if len(page.HTML) > errorPageMaxHTML {
+			return fmt.Errorf("error page %q is larger than %d bytes", kind, errorPageMaxHTML)
+		}
+		page.tmpl = nil
+		if page.HTML != "" {
+			t, err := template.New(kind).Parse(page.HTML)
+			if err != nil {
+				return fmt.Errorf("error page %q: %v", kind, err)
+			}
+			page.tmpl = t
+		}
+		pages[kind] = page
+	}
+	return nil
+}
+
+// errorPageKinds lists the configured kinds, for /.wormkey/state.
+func errorPageKinds(pages map[string]errorPage) []string {
+	kinds := make([]string, 0, len(pages))
+	for kind := range pages {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// acceptsJSON reports whether the viewer asked for JSON rather than a page: a JSON media
+// type in Accept and no text/html (browsers navigating always list text/html).
+func acceptsJSON(r *http.Request) bool {
+	accept := strings.ToLower(strings.Join(r.Header.Values("Accept"), ","))
+	if strings.Contains(accept, "text/html") {
+		return false
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return true
+		}
+	}
+	return false
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// plainText turns the built-in messages (which use <code>) into text for JSON, templates
+// and gRPC statuses.
+func plainText(s string) string {
+	return html.UnescapeString(htmlTag.ReplaceAllString(s, ""))
+}
+
+func writeErrorPage(w http.ResponseWriter, kind string, status int, title, message string) {
+	rec, _ := w.(*responseRecorder)
+	if rec != nil && rec.grpc {
+		writeGRPCStatus(w, grpcCodeForHTTP(status), title+": "+message)
+		return
+	}
+	var page errorPage
+	if rec != nil {
+		var ok bool
+		if page, ok = rec.errorPages[kind]; !ok {
+			page = rec.errorPages["default"]
+		}
+	}
+	text := plainText(message)
+	if page.Title != "" {
+		title = page.Title
+	}
+	if page.Message != "" {
+		text = page.Message
+		message = html.EscapeString(page.Message)
+	}
+	if rec != nil && rec.acceptJSON {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"error":     kind,
+			"status":    status,
+			"title":     title,
+			"message":   text,
+			"requestId": w.Header().Get(requestIDHeader),
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if page.tmpl != nil {
+		var buf bytes.Buffer
+		data := errorPageData{Kind: kind, Status: status, Title: title, Message: text, RequestID: w.Header().Get(requestIDHeader)}
+		if page.tmpl.Execute(&buf, data) == nil {
+			w.WriteHeader(status)
+			_, _ = buf.WriteTo(w)
+			return
+		}
+	}
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1"><title>`+html.EscapeString(title)+`</title>
+<style>
+*{box-sizing:border-box}
+body{margin:0;font-family:ui-sans-serif,system-ui,sans-serif;background:#0f0f0f;color:#f4f4f4;min-height:100vh;display:flex;align-items:center;justify-content:center;padding:2rem}
+.wrap{text-align:center;max-width:28rem}
+h1{font-size:1.25rem;font-weight:600;margin:0 0 0.5rem}
+p{color:#a3a3a3;margin:0;line-height:1.6}
+code{background:#262626;padding:0.2em 0.4em;border-radius:4px;font-size:0.9em}
+a{color:#60a5fa;text-decoration:none}
+a:hover{text-decoration:underline}
+</style>
+</head>
+<body>
+<div class="wrap">
+`+mascotHTML+`
+<h1>`+html.EscapeString(title)+`</h1>
+<p>`+message+`</p>
+<p style="margin-top:1.5rem"><a href="https://wormkey.run">wormkey.run</a></p>
+</div>
+</body>
+</html>`)
+}
+
+// handleErrorPages lets the owner manage error pages without JSON-encoding HTML:
+// GET lists them (or previews one with ?kind=), PUT ?kind= uploads a page template as the
+// request body, DELETE ?kind= removes one (all without kind).
+func handleErrorPages(tunnels *sync.Map, controlPlaneURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := resolveSlug(r)
+		val, ok := tunnels.Load(slug)
+		if !ok {
+			http.Error(w, "Tunnel not connected", 503)
+			return
+		}
+		tc := val.(*tunnelConn)
+		if !isOwner(r, tc) {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		kind := r.URL.Query().Get("kind")
+		if r.Method == http.MethodGet {
+			tc.policyMu.RLock()
+			pages := tc.policy.ErrorPages
+			tc.policyMu.RUnlock()
+			if kind == "" {
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(map[string]any{"errorPages": pages})
+				return
+			}
+			preview, ok := errorPageWriters[kind]
+			if kind == "default" {
+				preview, ok = writeWormholeNotActive, true
+				pages = map[string]errorPage{"default": pages["default"]}
+			}
+			if !ok {
+				http.Error(w, "Unknown error page kind", 400)
+				return
+			}
+			preview(&responseRecorder{ResponseWriter: w, acceptJSON: acceptsJSON(r), errorPages: pages})
+			return
+		}
+		if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		if r.Method == http.MethodPut && kind == "" {
+			http.Error(w, "Missing kind", 400)
+			return
+		}
+		var body []byte
+		if r.Method == http.MethodPut {
+			var err error
+			if body, err = io.ReadAll(io.LimitReader(r.Body, errorPageMaxHTML+1)); err != nil {
+				http.Error(w, "Could not read body", 400)
+				return
+			}
+		}
+		// Read, change and store under one lock so concurrent updates are not lost.
+		tc.policyMu.Lock()
+		updated := map[string]errorPage{}
+		for k, p := range tc.policy.ErrorPages {
+			updated[k] = p
+		}
+		switch {
+		case r.Method == http.MethodDelete && kind == "":
+			updated = nil
+		case r.Method == http.MethodDelete:
+			delete(updated, kind)
+		default:
+			page := updated[kind]
+			page.HTML = string(body)
+			updated[kind] = page
+		}
+		if err := prepareErrorPages(updated); err != nil {
+			tc.policyMu.Unlock()
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		tc.policy.ErrorPages = updated
+		policy := tc.policy
+		tc.policyMu.Unlock()
+		go syncPolicy(controlPlaneURL, slug, policy)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "errorPages": errorPageKinds(updated)})
+	}
+}
@@ -0,0 +1,65 @@
+// gRPC over wormholes: requests travel like any other stream (HTTP/2 at the edge, body and
+// response streamed frame by frame, status in RESPONSE_TRAILERS). Errors the gateway itself
+// produces are sent as gRPC statuses instead of HTML pages so clients see a real code.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes used by the gateway.
+const (
+	grpcUnknown          = 2
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcCodeForHTTP maps a gateway HTTP status to a gRPC code per the gRPC HTTP mapping.
+func grpcCodeForHTTP(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// writeGRPCStatus sends a Trailers-Only response: HTTP 200 with the status in the headers.
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	h.Set("Grpc-Message", grpcEncodeMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// setGRPCTrailerStatus reports a failure after the response headers have gone out.
+func setGRPCTrailerStatus(w http.ResponseWriter, code int, message string) {
+	h := w.Header()
+	h.Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	h.Set(http.TrailerPrefix+"Grpc-Message", grpcEncodeMessage(message))
+}
+
+// grpcEncodeMessage percent-encodes a status message as gRPC requires, dropping HTML markup
+// from the gateway's error page text.
+func grpcEncodeMessage(message string) string {
+	return strings.ReplaceAll(url.PathEscape(plainText(message)), "%20", " ")
+}
@@ -0,0 +1,424 @@
+// Owner overlay injection. HTML responses to the tunnel owner get the overlay script
+// inserted before </body> while they stream: chunks go out as they arrive, holding back
+// only what could be the start of a "</body>" split across chunks. Bodies encoded with
+// gzip, deflate, br or zstd are decoded and re-encoded on the fly.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// overlayInjectWriter wraps the viewer response of an owner request.
+type overlayInjectWriter struct {
+	w      http.ResponseWriter
+	tc     *tunnelConn
+	path   string
+	host   string
+	https  bool
+	inject bool       // this response is being rewritten
+	out    injectSink // set when inject is
+}
+
+// injectSink receives the response body. close(true) finishes it at STREAM_END;
+// close(false) abandons it when the stream is cancelled. close returns errRecodeFailed
+// when the viewer got part of a body that could not be completed.
+type injectSink interface {
+	io.Writer
+	close(complete bool) error
+}
+
+func (o *overlayInjectWriter) Header() http.Header { return o.w.Header() }
+
+func (o *overlayInjectWriter) WriteHeader(status int) {
+	if o.out == nil && canInjectOverlay(status, o.w.Header()) {
+		o.start()
+	}
+	o.w.WriteHeader(status)
+}
+
+// start sets up injection for an HTML response, fitting the page's CSP to the overlay.
+func (o *overlayInjectWriter) start() {
+	h := o.w.Header()
+	encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding")))
+	if !supportedEncodings[encoding] {
+		o.tc.reportOverlay(o.path, false, "", "unsupported Content-Encoding "+encoding)
+		return
+	}
+	nonce := ""
+	csp := ""
+	if len(h.Values("Content-Security-Policy")) > 0 {
+		if nonce = cspNonce(h); nonce == "" {
+			nonce = randomSecret(16)
+		}
+		changed, reason := fitOverlayCSP(h, o.host, o.https, nonce)
+		if reason != "" {
+			o.tc.reportOverlay(o.path, false, "", reason)
+			return
+		}
+		if changed {
+			csp = "updated"
+		}
+	}
+	o.tc.reportOverlay(o.path, true, csp, "")
+	o.inject = true
+	inj := &scriptInjector{w: o.w, script: overlayTag(o.tc.slug, nonce)}
+	o.out = inj
+	if encoding != "" && encoding != "identity" {
+		o.out = newRecoder(encoding, inj, o.w)
+	}
+	h.Del("Content-Length")
+	h.Del("Trailer") // trailers are dropped for rewritten bodies
+}
+
+func (o *overlayInjectWriter) Write(p []byte) (int, error) {
+	if o.inject {
+		return o.out.Write(p)
+	}
+	return o.w.Write(p)
+}
+
+func (o *overlayInjectWriter) Flush() {
+	if f, ok := o.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (o *overlayInjectWriter) Unwrap() http.ResponseWriter { return o.w }
+
+func (o *overlayInjectWriter) close(complete bool) error {
+	if o.inject {
+		return o.out.close(complete)
+	}
+	return nil
+}
+
+func canInjectOverlay(status int, h http.Header) bool {
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	return strings.Contains(strings.ToLower(h.Get("Content-Type")), "text/html") && !isStreamingResponse(h)
+}
+
+var supportedEncodings = map[string]bool{"": true, "identity": true, "gzip": true, "x-gzip": true, "deflate": true, "br": true, "zstd": true}
+
+func overlayTag(slug, nonce string) []byte {
+	attr := ""
+	if nonce != "" {
+		attr = ` nonce="` + html.EscapeString(nonce) + `"`
+	}
+	return []byte(fmt.Sprintf(`<script defer src="/.wormkey/overlay.js?slug=%s"%s></script>`, url.QueryEscape(slug), attr))
+}
+
+// cspNonce returns the nonce the response's Content-Security-Policy allows scripts with,
+// so the overlay tag can reuse it rather than adding another to the policy.
+func cspNonce(h http.Header) string {
+	for _, policy := range h.Values("Content-Security-Policy") {
+		var fallback string
+		for _, directive := range strings.Split(policy, ";") {
+			fields := strings.Fields(directive)
+			if len(fields) == 0 {
+				continue
+			}
+			name := strings.ToLower(fields[0])
+			if name != "script-src" && name != "script-src-elem" && name != "default-src" {
+				continue
+			}
+			for _, src := range fields[1:] {
+				if n, ok := strings.CutPrefix(src, "'nonce-"); ok && strings.HasSuffix(n, "'") {
+					if name != "default-src" {
+						return strings.TrimSuffix(n, "'")
+					}
+					fallback = strings.TrimSuffix(n, "'")
+				}
+			}
+		}
+		if fallback != "" {
+			return fallback
+		}
+	}
+	return ""
+}
+
+var bodyClose = []byte("</body>")
+
+// scriptInjector copies HTML to w, inserting script before the first </body>, or at the
+// end if there is none.
+type scriptInjector struct {
+	w      io.Writer
+	script []byte
+	held   []byte // tail of the last chunk that may begin a </body>
+	done   bool
+}
+
+func (s *scriptInjector) Write(p []byte) (int, error) {
+	if s.done {
+		return s.w.Write(p)
+	}
+	data := append(s.held, p...)
+	s.held = nil
+	if i := indexFold(data, bodyClose); i >= 0 {
+		s.done = true
+		if _, err := s.w.Write(data[:i]); err != nil {
+			return 0, err
+		}
+		if _, err := s.w.Write(s.script); err != nil {
+			return 0, err
+		}
+		_, err := s.w.Write(data[i:])
+		return len(p), err
+	}
+	keep := partialSuffix(data, bodyClose)
+	s.held = append([]byte(nil), data[len(data)-keep:]...)
+	if _, err := s.w.Write(data[:len(data)-keep]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *scriptInjector) close(complete bool) error {
+	if complete && !s.done {
+		s.done = true
+		s.w.Write(s.held)
+		s.w.Write(s.script)
+	}
+	return nil
+}
+
+// indexFold is bytes.Index ignoring ASCII case in data (sep is lower case).
+func indexFold(data, sep []byte) int {
+	for i := 0; i+len(sep) <= len(data); i++ {
+		if bytes.EqualFold(data[i:i+len(sep)], sep) {
+			return i
+		}
+	}
+	return -1
+}
+
+// partialSuffix returns the length of the longest proper prefix of sep that data ends with.
+func partialSuffix(data, sep []byte) int {
+	for n := len(sep) - 1; n > 0; n-- {
+		if len(data) >= n && bytes.EqualFold(data[len(data)-n:], sep[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// recoder decodes an encoded body, passes it through an injector and re-encodes it to w.
+// The codecs pull their input, so they run in a goroutine fed by Write; Write returns only
+// once the chunk is consumed and the encoder flushed, so w is never written between calls.
+// A body that fails to decode before anything reached w is passed through unchanged;
+// after that, Write returns errRecodeFailed and the response has to be aborted.
+type recoder struct {
+	in      chan []byte
+	idle    chan struct{} // the decoder has consumed every chunk written so far
+	done    chan struct{}
+	buf     []byte
+	raw     []byte // input so far, kept until the encoder first writes to out
+	out     *countingWriter
+	started bool
+	eof     bool
+	aborted bool
+	flush   func() error
+	err     error
+}
+
+// errRecodeFailed means the encoded body broke off after part of the rewritten body was
+// sent, so the viewer's response cannot be completed.
+var errRecodeFailed = errors.New("response body could not be decoded")
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newRecoder(encoding string, inj *scriptInjector, w io.Writer) *recoder {
+	rc := &recoder{in: make(chan []byte), idle: make(chan struct{}), done: make(chan struct{}), out: &countingWriter{w: w}}
+	go rc.run(encoding, inj)
+	return rc
+}
+
+func (rc *recoder) run(encoding string, inj *scriptInjector) {
+	defer close(rc.done)
+	dec, raw, err := newDecoder(encoding, rc)
+	if err == io.EOF {
+		return // empty body
+	}
+	if err != nil {
+		rc.fail(encoding, err)
+		return
+	}
+	defer dec.Close()
+	enc, err := newEncoder(encoding, raw, rc.out)
+	if err != nil {
+		rc.err = err
+		return
+	}
+	inj.w = enc
+	rc.flush = enc.Flush
+	_, err = io.Copy(inj, dec)
+	if rc.aborted {
+		return
+	}
+	if err != nil {
+		rc.fail(encoding, err)
+		return
+	}
+	inj.close(true)
+	rc.err = enc.Close()
+}
+
+// fail handles a body that does not decode. Until the encoder has written anything the
+// raw input is still at hand, so it and the rest of the body go out unchanged, without
+// the overlay. Otherwise Write reports errRecodeFailed.
+func (rc *recoder) fail(encoding string, err error) {
+	if rc.out.n > 0 {
+		log.Printf("overlay: %s body broke off mid-stream, aborting the response: %v", encoding, err)
+		rc.err = fmt.Errorf("%w: %v", errRecodeFailed, err)
+		return
+	}
+	log.Printf("overlay: %s body could not be decoded, passing it through without the overlay: %v", encoding, err)
+	if _, rc.err = rc.out.Write(rc.raw); rc.err != nil {
+		return
+	}
+	rc.raw = nil
+	for !rc.eof {
+		rc.idle <- struct{}{} // release the Write whose chunk failed, then the later ones
+		b, ok := <-rc.in
+		if !ok {
+			return
+		}
+		if _, rc.err = rc.out.Write(b); rc.err != nil {
+			return
+		}
+	}
+}
+
+// Read feeds the decoder. An empty buffer means everything written so far has been
+// decoded, so the output is flushed and Write is released before waiting for more.
+func (rc *recoder) Read(p []byte) (int, error) {
+	for len(rc.buf) == 0 {
+		if rc.eof {
+			return 0, io.EOF
+		}
+		if rc.started {
+			if rc.flush != nil { // nil while the decoder is still reading its header
+				if err := rc.flush(); err != nil {
+					return 0, err
+				}
+			}
+			rc.idle <- struct{}{}
+		}
+		rc.started = true
+		b, ok := <-rc.in
+		if !ok {
+			rc.eof = true
+			return 0, io.EOF
+		}
+		rc.buf = b
+		if rc.out.n == 0 {
+			rc.raw = append(rc.raw, b...)
+		} else {
+			rc.raw = nil
+		}
+	}
+	n := copy(p, rc.buf)
+	rc.buf = rc.buf[n:]
+	return n, nil
+}
+
+func (rc *recoder) Write(p []byte) (int, error) {
+	select {
+	case rc.in <- p:
+	case <-rc.done:
+		return 0, rc.err
+	}
+	select {
+	case <-rc.idle:
+	case <-rc.done:
+		if errors.Is(rc.err, errRecodeFailed) {
+			return 0, rc.err
+		}
+	}
+	return len(p), nil
+}
+
+func (rc *recoder) close(complete bool) error {
+	rc.aborted = !complete
+	close(rc.in)
+	<-rc.done
+	if errors.Is(rc.err, errRecodeFailed) {
+		return rc.err
+	}
+	return nil
+}
+
+// newDecoder returns a decoder for the body. raw reports a "deflate" body sent without the
+// zlib wrapper, which some servers do; it is re-encoded the same way.
+func newDecoder(encoding string, r io.Reader) (dec io.ReadCloser, raw bool, err error) {
+	switch encoding {
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), false, nil
+	case "zstd":
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, false, err
+		}
+		return d.IOReadCloser(), false, nil
+	case "deflate":
+		br := bufio.NewReader(r)
+		hdr, err := br.Peek(2)
+		if err != nil {
+			return nil, false, err
+		}
+		if hdr[0]&0x0f == 8 && (uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0 {
+			dec, err := zlib.NewReader(br)
+			return dec, false, err
+		}
+		return flate.NewReader(br), true, nil
+	}
+	dec, err = gzip.NewReader(r)
+	return dec, false, err
+}
+
+func newEncoder(encoding string, raw bool, w io.Writer) (flushWriteCloser, error) {
+	switch encoding {
+	case "br":
+		return brotli.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case "deflate":
+		if raw {
+			return flate.NewWriter(w, flate.DefaultCompression)
+		}
+		return zlib.NewWriter(w), nil
+	}
+	return gzip.NewWriter(w), nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+const testScript = "<script>overlay</script>"
+
+func TestScriptInjector(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunks   []string
+		complete bool
+		want     string
+	}{
+		{"one chunk", []string{"<p>hi</p></body></html>"}, true, "<p>hi</p>" + testScript + "</body></html>"},
+		{"split tag", []string{"<p>hi</p></bo", "dy></html>"}, true, "<p>hi</p>" + testScript + "</body></html>"},
+		{"split after <", []string{"<p>hi</p><", "/body>"}, true, "<p>hi</p>" + testScript + "</body>"},
+		{"split across three chunks", []string{"<p>hi</p></", "bo", "dy>"}, true, "<p>hi</p>" + testScript + "</body>"},
+		{"upper case", []string{"<P>hi</P></BO", "DY></HTML>"}, true, "<P>hi</P>" + testScript + "</BODY></HTML>"},
+		{"false start", []string{"<p>a</b", "r></p></bo", "dy>"}, true, "<p>a</br></p>" + testScript + "</body>"},
+		{"only first body", []string{"</body></bo", "dy>"}, true, testScript + "</body></body>"},
+		{"no body tag", []string{"<p>hi</p></bo"}, true, "<p>hi</p></bo" + testScript},
+		{"incomplete response", []string{"<p>hi</p></bo"}, false, "<p>hi</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			inj := &scriptInjector{w: &out, script: []byte(testScript)}
+			for _, c := range tt.chunks {
+				if n, err := inj.Write([]byte(c)); err != nil || n != len(c) {
+					t.Fatalf("Write(%q) = %d, %v", c, n, err)
+				}
+			}
+			inj.close(tt.complete)
+			if got := out.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecoderRoundTrip(t *testing.T) {
+	page := "<!DOCTYPE html><html><head><title>t</title></head><body>" + string(bytes.Repeat([]byte("<p>hello</p>"), 200)) + "</body></html>"
+	want := page[:len(page)-len("</body></html>")] + testScript + "</body></html>"
+	tests := []struct {
+		encoding string
+		raw      bool // deflate without the zlib wrapper
+	}{
+		{"gzip", false},
+		{"br", false},
+		{"zstd", false},
+		{"deflate", false},
+		{"deflate", true},
+	}
+	for _, tt := range tests {
+		name := tt.encoding
+		if tt.raw {
+			name += " raw"
+		}
+		t.Run(name, func(t *testing.T) {
+			var encoded bytes.Buffer
+			enc, err := newEncoder(tt.encoding, tt.raw, &encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(enc, page)
+			if err := enc.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			rc := newRecoder(tt.encoding, &scriptInjector{script: []byte(testScript)}, &out)
+			body := encoded.Bytes()
+			for len(body) > 0 {
+				n := min(len(body), 7) // small chunks split headers, blocks and </body>
+				if _, err := rc.Write(body[:n]); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+				body = body[n:]
+			}
+			rc.close(true)
+			if rc.err != nil {
+				t.Fatalf("recode: %v", rc.err)
+			}
+
+			dec, raw, err := newDecoder(tt.encoding, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if raw != tt.raw {
+				t.Errorf("re-encoded raw = %v, want %v", raw, tt.raw)
+			}
+			got, err := io.ReadAll(dec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRecoderEmptyBody(t *testing.T) {
+	var out bytes.Buffer
+	rc := newRecoder("gzip", &scriptInjector{script: []byte(testScript)}, &out)
+	rc.close(true)
+	if rc.err != nil || out.Len() != 0 {
+		t.Errorf("empty body: err %v, wrote %d bytes", rc.err, out.Len())
+	}
+}
+
+func TestRecoderPassThroughUndecodable(t *testing.T) {
+	// Labelled gzip but sent as plain HTML: the body goes out untouched, without the overlay.
+	page := "<html><body>" + string(bytes.Repeat([]byte("<p>hello</p>"), 50)) + "</body></html>"
+	var out bytes.Buffer
+	rc := newRecoder("gzip", &scriptInjector{script: []byte(testScript)}, &out)
+	for body := page; len(body) > 0; {
+		n := min(len(body), 7)
+		if _, err := rc.Write([]byte(body[:n])); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		body = body[n:]
+	}
+	if err := rc.close(true); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if out.String() != page {
+		t.Errorf("got %q, want the raw body", out.String())
+	}
+}
+
+func TestRecoderBrokenAfterOutput(t *testing.T) {
+	page := "<html><body>" + string(bytes.Repeat([]byte("<p>hello</p>"), 200)) + "</body></html>"
+	var encoded bytes.Buffer
+	enc, _ := newEncoder("gzip", false, &encoded)
+	io.WriteString(enc, page)
+	enc.Close()
+	tests := []struct {
+		name string
+		tail []byte // what follows the first half of the stream
+	}{
+		{"truncated", nil},
+		{"garbage", bytes.Repeat([]byte{0xff}, 64)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			rc := newRecoder("gzip", &scriptInjector{script: []byte(testScript)}, &out)
+			half := encoded.Bytes()[:encoded.Len()/2]
+			if _, err := rc.Write(half); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if out.Len() == 0 {
+				t.Fatal("nothing was re-encoded from the first half")
+			}
+			var err error
+			if tt.tail != nil {
+				_, err = rc.Write(tt.tail)
+			}
+			if closeErr := rc.close(err == nil); err == nil {
+				err = closeErr
+			}
+			if !errors.Is(err, errRecodeFailed) {
+				t.Errorf("err = %v, want errRecodeFailed", err)
+			}
+		})
+	}
+}
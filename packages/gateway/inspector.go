@@ -0,0 +1,279 @@
+// Owner request inspector: bounded per-tunnel history of proxied requests plus an SSE live feed.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	inspectorCapacity  = 100      // requests kept per tunnel
+	inspectorBodyLimit = 64 << 10 // bytes of each request/response body kept
+)
+
+// cappedBuffer keeps the first limit bytes written to it. Safe for concurrent use
+// because request bodies are pumped on their own goroutine.
+type cappedBuffer struct {
+	mu        sync.Mutex
+	buf       []byte
+	limit     int
+	truncated bool
+}
+
+func newCappedBuffer(limit int) *cappedBuffer { return &cappedBuffer{limit: limit} }
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	room := c.limit - len(c.buf)
+	if room <= 0 {
+		if len(p) > 0 {
+			c.truncated = true
+		}
+		return len(p), nil
+	}
+	if len(p) > room {
+		c.buf = append(c.buf, p[:room]...)
+		c.truncated = true
+		return len(p), nil
+	}
+	c.buf = append(c.buf, p...)
+	return len(p), nil
+}
+
+func (c *cappedBuffer) snapshot() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.buf...), c.truncated
+}
+
+// inspectedBody is a captured body. Non-UTF-8 bodies are base64 encoded.
+type inspectedBody struct {
+	Data      string `json:"data"`
+	Encoding  string `json:"encoding,omitempty"` // "base64" or empty for text
+	Size      int    `json:"size"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+func newInspectedBody(c *cappedBuffer) inspectedBody {
+	if c == nil {
+		return inspectedBody{}
+	}
+	b, truncated := c.snapshot()
+	body := inspectedBody{Size: len(b), Truncated: truncated}
+	if utf8.Valid(b) {
+		body.Data = string(b)
+	} else {
+		body.Data = base64.StdEncoding.EncodeToString(b)
+		body.Encoding = "base64"
+	}
+	return body
+}
+
+func (b inspectedBody) decode() []byte {
+	if b.Encoding == "base64" {
+		out, _ := base64.StdEncoding.DecodeString(b.Data)
+		return out
+	}
+	return []byte(b.Data)
+}
+
+type inspectedRequest struct {
+	ID               string        `json:"id"`
+	StreamID         uint32        `json:"streamId,omitempty"`
+	Method           string        `json:"method"`
+	Proto            string        `json:"proto"`
+	Path             string        `json:"path"`
+	RequestHeaders   http.Header   `json:"requestHeaders"`
+	RequestBody      inspectedBody `json:"requestBody"`
+	Status           int           `json:"status"`
+	ResponseHeaders  http.Header   `json:"responseHeaders,omitempty"`
+	ResponseBody     inspectedBody `json:"responseBody"`
+	ResponseTrailers http.Header   `json:"responseTrailers,omitempty"`
+	StartedAt        string        `json:"startedAt"`
+	DurationMs       float64       `json:"durationMs"`
+	ViewerID         string        `json:"viewerId,omitempty"`
+	Owner            bool          `json:"owner"`
+	Rejection        string        `json:"rejection,omitempty"`
+	RejectionDetail  string        `json:"rejectionDetail,omitempty"`
+	ReplayOf         string        `json:"replayOf,omitempty"`   // id of the original when this is a replay
+	CapturedAt       string        `json:"capturedAt,omitempty"` // set when delivered from the offline capture queue
+}
+
+type requestInspector struct {
+	mu      sync.Mutex
+	entries []*inspectedRequest // ring buffer, oldest at next when full
+	next    int
+	subs    map[chan *inspectedRequest]struct{}
+}
+
+func newRequestInspector() *requestInspector {
+	return &requestInspector{subs: map[chan *inspectedRequest]struct{}{}}
+}
+
+func (ri *requestInspector) record(req *inspectedRequest) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	if len(ri.entries) < inspectorCapacity {
+		ri.entries = append(ri.entries, req)
+	} else {
+		ri.entries[ri.next] = req
+		ri.next = (ri.next + 1) % inspectorCapacity
+	}
+	for ch := range ri.subs {
+		select {
+		case ch <- req:
+		default: // slow subscriber; it can refetch the list
+		}
+	}
+}
+
+// snapshot returns recorded requests, oldest first.
+func (ri *requestInspector) snapshot() []*inspectedRequest {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	out := make([]*inspectedRequest, 0, len(ri.entries))
+	out = append(out, ri.entries[ri.next:]...)
+	out = append(out, ri.entries[:ri.next]...)
+	return out
+}
+
+func (ri *requestInspector) find(id string) *inspectedRequest {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	for _, e := range ri.entries {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+func (ri *requestInspector) subscribe() chan *inspectedRequest {
+	ch := make(chan *inspectedRequest, 16)
+	ri.mu.Lock()
+	ri.subs[ch] = struct{}{}
+	ri.mu.Unlock()
+	return ch
+}
+
+func (ri *requestInspector) unsubscribe(ch chan *inspectedRequest) {
+	ri.mu.Lock()
+	delete(ri.subs, ch)
+	ri.mu.Unlock()
+}
+
+// redactGatewayCookies hides Wormkey's own credentials from captured request headers.
+func redactGatewayCookies(h http.Header) http.Header {
+	h = h.Clone()
+	cookies := h.Values("Cookie")
+	if len(cookies) == 0 {
+		return h
+	}
+	h.Del("Cookie")
+	for _, line := range cookies {
+		parts := strings.Split(line, ";")
+		for i, part := range parts {
+			name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "wormkey_owner" || name == "wormkey_pass" {
+				parts[i] = " " + name + "=[redacted]"
+			}
+		}
+		h.Add("Cookie", strings.TrimSpace(strings.Join(parts, ";")))
+	}
+	return h
+}
+
+// inspect builds the inspector record for a finished handleProxy request.
+func inspect(r *http.Request, e *accessEntry, rec *responseRecorder, reqBody *cappedBuffer, start time.Time, d time.Duration) *inspectedRequest {
+	return &inspectedRequest{
+		ID:               e.requestID,
+		StreamID:         e.streamID,
+		Method:           r.Method,
+		Proto:            r.Proto,
+		Path:             r.URL.RequestURI(),
+		RequestHeaders:   redactGatewayCookies(r.Header),
+		RequestBody:      newInspectedBody(reqBody),
+		Status:           rec.statusCode(),
+		ResponseHeaders:  rec.header,
+		ResponseBody:     newInspectedBody(rec.body),
+		ResponseTrailers: rec.trailers(),
+		StartedAt:        start.UTC().Format(time.RFC3339Nano),
+		DurationMs:       float64(d.Microseconds()) / 1000,
+		ViewerID:         e.viewerID,
+		Owner:            e.owner,
+		Rejection:        e.rejection,
+		RejectionDetail:  e.detail,
+	}
+}
+
+func handleInspectorList(tunnels *sync.Map) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := resolveSlug(r)
+		val, ok := tunnels.Load(slug)
+		if !ok {
+			http.Error(w, "Tunnel not connected", 503)
+			return
+		}
+		tc := val.(*tunnelConn)
+		if !isOwner(r, tc) {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"requests": tc.inspector.snapshot()})
+	}
+}
+
+func handleInspectorLive(tunnels *sync.Map) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := resolveSlug(r)
+		val, ok := tunnels.Load(slug)
+		if !ok {
+			http.Error(w, "Tunnel not connected", 503)
+			return
+		}
+		tc := val.(*tunnelConn)
+		if !isOwner(r, tc) {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", 500)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		ch := tc.inspector.subscribe()
+		defer tc.inspector.unsubscribe(ch)
+		keepalive := time.NewTicker(20 * time.Second)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case req := <-ch:
+				b, err := json.Marshal(req)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "event: request\ndata: %s\n\n", b)
+				flusher.Flush()
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -4,18 +4,23 @@
 package main
 
 import (
-	_ "embed"
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	_ "embed"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -24,6 +29,14 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 //go:embed overlay.js
@@ -42,6 +55,9 @@ const (
 	FramePong         = 0x0a
 	FramePause        = 0x0b
 	FrameResume       = 0x0c
+	FrameTCPOpen      = 0x0d
+	FrameDatagram     = 0x0e
+	FrameResponseTrls = 0x0f
 	ControlStreamID   = 0
 )
 
@@ -49,95 +65,72 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
+// controlPlaneSecret is the shared key used to sign gateway -> control plane requests.
+// Empty disables signing (local dev against an unsecured control plane).
+var controlPlaneSecret string
+
 type tunnelConn struct {
-	conn          *websocket.Conn
-	slug          string
-	ownerToken    string
-	streamID      atomic.Uint32
-	activeStreams atomic.Int32
-	paused        atomic.Bool
-	streams       sync.Map   // streamID -> *streamCtx
-	writeMu       sync.Mutex // WebSocket writes must be serialized
-	policyMu      sync.RWMutex
-	policy        tunnelPolicy
-	viewerMu      sync.RWMutex
-	viewers       map[string]*viewerState
-	kickedViewers map[string]struct{}
+	conn             *websocket.Conn
+	slug             string
+	ownerToken       string
+	session          sessionRef // zero when the control plane could not be reached
+	streamID         atomic.Uint32
+	activeStreams    atomic.Int32
+	streamingStreams atomic.Int32 // SSE and other streaming responses, not in activeStreams
+	paused           atomic.Bool
+	streams          sync.Map   // streamID -> *streamCtx
+	writeMu          sync.Mutex // WebSocket writes must be serialized
+	policyMu         sync.RWMutex
+	policy           tunnelPolicy
+	viewerMu         sync.RWMutex
+	viewers          map[string]*viewerState
+	kickedViewers    map[string]struct{}
+	inspector        *requestInspector
+	overlay          atomic.Pointer[overlayReport]
+	cache            *edgeCache
+	closed           chan struct{} // closed when the tunnel read loop exits
+	mode             string        // "http", "tcp" or "udp"
+	tcpStreams       sync.Map      // streamID -> *tcpStream
+	udpFlows         sync.Map      // streamID -> *udpFlow
+	udpByAddr        sync.Map      // remote addr -> *udpFlow
 }
 
 type tunnelPolicy struct {
-	Public               bool     `json:"public"`
-	MaxConcurrentViewers int      `json:"maxConcurrentViewers"`
-	BlockPaths           []string `json:"blockPaths"`
-	Password             string   `json:"password"`
+	Public               bool                 `json:"public"`
+	MaxConcurrentViewers int                  `json:"maxConcurrentViewers"`
+	BlockPaths           []string             `json:"blockPaths"`
+	Password             string               `json:"password"`
+	Capture              *capturePolicy       `json:"capture,omitempty"`
+	Signatures           []signatureRule      `json:"signatures,omitempty"`
+	Cache                *cachePolicy         `json:"cache,omitempty"`
+	ErrorPages           map[string]errorPage `json:"errorPages,omitempty"`
 }
 
 type streamCtx struct {
+	mu        sync.Mutex // held while writing to w; the handler may return once ended is set
+	ended     bool
 	w         http.ResponseWriter
 	done      chan struct{}
 	flusher   http.Flusher
 	setCookie string // slug for Set-Cookie so asset requests get routed
-}
-
-// overlayInjectWriter buffers HTML responses for owners and injects the overlay script before </body>.
-type overlayInjectWriter struct {
-	w      http.ResponseWriter
-	slug   string
-	status int
-	buf    bytes.Buffer
-	inject bool
-}
-
-func (o *overlayInjectWriter) Header() http.Header { return o.w.Header() }
-
-func (o *overlayInjectWriter) WriteHeader(status int) {
-	ct := o.w.Header().Get("Content-Type")
-	if strings.Contains(strings.ToLower(ct), "text/html") {
-		o.status = status
-		o.inject = true
-		return
-	}
-	o.w.WriteHeader(status)
-}
-
-func (o *overlayInjectWriter) Write(p []byte) (int, error) {
-	if o.inject {
-		o.buf.Write(p)
-		return len(p), nil
-	}
-	return o.w.Write(p)
-}
-
-func (o *overlayInjectWriter) FlushInject() {
-	if !o.inject {
-		return
-	}
-	body := o.buf.Bytes()
-	script := []byte(fmt.Sprintf(`<script defer src="/.wormkey/overlay.js?slug=%s"></script>`, url.QueryEscape(o.slug)))
-	lower := bytes.ToLower(body)
-	idx := bytes.Index(lower, []byte("</body>"))
-	if idx >= 0 {
-		var out bytes.Buffer
-		out.Write(body[:idx])
-		out.Write(script)
-		out.Write(body[idx:])
-		body = out.Bytes()
-	} else {
-		var out bytes.Buffer
-		out.Write(body)
-		out.Write(script)
-		body = out.Bytes()
-	}
-	o.w.Header().Del("Transfer-Encoding")
-	o.w.Header().Set("Content-Length", strconv.Itoa(len(body)))
-	o.w.WriteHeader(o.status)
-	o.w.Write(body)
+	trace     *streamTrace
+	grpc      bool // gRPC request: failures are reported as grpc-status
+	wroteHdr  bool // RESPONSE_HEADERS has been written to w
+	streaming bool // response headers marked this as a streaming response
+	lastWrite time.Time
+	lineStart bool       // last body byte was a newline (an SSE comment can be written)
+	fill      *cacheFill // collects the response for the edge cache, if cacheable
+	aborted   bool       // the body could not be written; the viewer's connection is reset
 }
 
 type policyPatch struct {
-	Public               *bool    `json:"public"`
-	MaxConcurrentViewers *int     `json:"maxConcurrentViewers"`
-	BlockPaths           []string `json:"blockPaths"`
+	Public               *bool                `json:"public"`
+	MaxConcurrentViewers *int                 `json:"maxConcurrentViewers"`
+	BlockPaths           []string             `json:"blockPaths"`
+	Capture              *capturePolicy       `json:"capture"`
+	Signatures           []signatureRule      `json:"signatures"`
+	Cache                *cachePolicy         `json:"cache"`
+	ErrorPages           map[string]errorPage `json:"errorPages"`
 }
 
 type viewerState struct {
@@ -154,6 +147,26 @@ type persistedSession struct {
 	KickedViewerIds []string      `json:"kickedViewerIds"`
 	ActiveViewers   []viewerState `json:"activeViewers"`
 	Closed          bool          `json:"closed"`
+	AccountID       string        `json:"accountId"`
+	SessionID       string        `json:"sessionId"`
+	ExpiresAt       string        `json:"expiresAt"`
+}
+
+// sessionRef identifies one session of a slug. The control plane hands a slug to a new
+// session once the previous one is closed or expired, so state that must not reach the
+// next owner (captured requests, custom domains) is keyed by session rather than slug.
+type sessionRef struct {
+	ID      string
+	Expires time.Time // zero when the control plane gave no expiry
+}
+
+func (s sessionRef) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && !now.Before(s.Expires)
+}
+
+func (sess persistedSession) ref() sessionRef {
+	expires, _ := time.Parse(time.RFC3339, sess.ExpiresAt)
+	return sessionRef{ID: sess.SessionID, Expires: expires}
 }
 
 func fetchSession(controlPlaneURL, slug string) (persistedSession, int, error) {
@@ -161,7 +174,12 @@ func fetchSession(controlPlaneURL, slug string) (persistedSession, int, error) {
 		return persistedSession{}, 0, fmt.Errorf("control plane url is empty")
 	}
 	url := strings.TrimRight(controlPlaneURL, "/") + "/sessions/by-slug/" + slug
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return persistedSession{}, 0, err
+	}
+	signControlPlaneRequest(req, nil)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return persistedSession{}, 0, err
 	}
@@ -173,9 +191,27 @@ func fetchSession(controlPlaneURL, slug string) (persistedSession, int, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&sess); err != nil {
 		return persistedSession{}, resp.StatusCode, err
 	}
+	if err := prepareErrorPages(sess.Policy.ErrorPages); err != nil {
+		log.Printf("session %s: %v", slug, err) // pages that fail to parse fall back to the defaults
+	}
 	return sess, resp.StatusCode, nil
 }
 
+// signControlPlaneRequest adds HMAC-SHA256 auth headers so the control plane can reject
+// calls that did not come from a gateway. The signed message is
+// "<unix ts>\n<METHOD>\n<path>\n<hex sha256(body)>".
+func signControlPlaneRequest(req *http.Request, body []byte) {
+	if controlPlaneSecret == "" {
+		return
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(controlPlaneSecret))
+	mac.Write([]byte(ts + "\n" + req.Method + "\n" + req.URL.EscapedPath() + "\n" + hex.EncodeToString(bodyHash[:])))
+	req.Header.Set("X-Wormkey-Timestamp", ts)
+	req.Header.Set("X-Wormkey-Signature", "v1="+hex.EncodeToString(mac.Sum(nil)))
+}
+
 func randomSecret(n int) string {
 	b := make([]byte, n)
 	if _, err := rand.Read(b); err != nil {
@@ -184,20 +220,45 @@ func randomSecret(n int) string {
 	return hex.EncodeToString(b)
 }
 
-// extractSlugFromHost extracts slug from host like "quiet-lime-82.wormkey.run" or "quiet-lime-82.wormkey.run:3002".
-// Assumes format: slug.wormkey.run (at least 3 dot-separated parts).
+// Routing configuration, set from the environment in main.
+var (
+	baseDomains   []string // wildcard domains wormholes live under (WORMKEY_BASE_DOMAINS)
+	strictRouting bool     // no ?slug= or cookie routing for app traffic (WORMKEY_STRICT_ROUTING)
+	pathRouting   = true   // /s/:slug routing (WORMKEY_PATH_ROUTING)
+)
+
+// extractSlugFromHost maps a host like "quiet-lime-82.wormkey.run:3002" to its slug. Verified
+// custom domains win; otherwise the host must be exactly one label under a base domain.
 func extractSlugFromHost(host string) string {
-	host = strings.Split(host, ":")[0] // strip port
-	parts := strings.Split(host, ".")
-	if len(parts) < 3 {
-		return ""
+	if s := domains.slugFor(host); s != "" {
+		return s
+	}
+	host = normalizeHostname(host)
+	for _, base := range baseDomains {
+		if sub, ok := strings.CutSuffix(host, "."+base); ok && sub != "" && !strings.Contains(sub, ".") {
+			return sub
+		}
+	}
+	return ""
+}
+
+// underBaseDomain reports whether host is a base domain or any name below one.
+func underBaseDomain(host string) bool {
+	for _, base := range baseDomains {
+		if host == base || strings.HasSuffix(host, "."+base) {
+			return true
+		}
 	}
-	return parts[0]
+	return false
 }
 
 func resolveSlug(r *http.Request) string {
+	// 0. Verified custom domain: the host alone decides, /s/ paths belong to the app
+	if s := domains.slugFor(r.Host); s != "" {
+		return s
+	}
 	// 1. Path-based: /s/:slug (no wildcard TLS needed)
-	if strings.HasPrefix(r.URL.Path, "/s/") {
+	if pathRouting && strings.HasPrefix(r.URL.Path, "/s/") {
 		rest := r.URL.Path[3:] // skip "/s/"
 		idx := strings.Index(rest, "/")
 		var slug string
@@ -218,17 +279,21 @@ func resolveSlug(r *http.Request) string {
 			return slug
 		}
 	}
-	// 2. Query fallback (?slug=)
-	slug := r.URL.Query().Get("slug")
-	if slug != "" {
-		return slug
+	// 2. Query fallback (?slug=). Strict mode keeps it only for the owner control
+	// endpoints, which authenticate separately and are called by the overlay.
+	if !strictRouting || strings.HasPrefix(r.URL.Path, "/.wormkey/") {
+		if slug := r.URL.Query().Get("slug"); slug != "" {
+			return slug
+		}
 	}
 	// 3. Cookie (for asset requests like /_next/... or /assets/...)
-	if c, err := r.Cookie("wormkey_slug"); err == nil && c.Value != "" {
-		return c.Value
-	}
-	if c, err := r.Cookie("wormkey"); err == nil && c.Value != "" {
-		return c.Value
+	if !strictRouting {
+		if c, err := r.Cookie("wormkey_slug"); err == nil && c.Value != "" {
+			return c.Value
+		}
+		if c, err := r.Cookie("wormkey"); err == nil && c.Value != "" {
+			return c.Value
+		}
 	}
 	// 4. Host-based (slug.wormkey.run)
 	if s := extractSlugFromHost(r.Host); s != "" {
@@ -259,68 +324,44 @@ function wormCycle(){wormI=(wormI+1)%8;var v=wormV[wormI];var d=document;["w-bod
 </script>`
 
 func writeWormholeNotActive(w http.ResponseWriter) {
-	writeErrorPage(w, http.StatusBadGateway, "Wormhole not active", "No tunnel is connected. Run <code>wormkey http &lt;port&gt;</code> to open a wormhole.")
+	writeErrorPage(w, "not_active", http.StatusBadGateway, "Wormhole not active", "No tunnel is connected. Run <code>wormkey http &lt;port&gt;</code> to open a wormhole.")
 }
 
 func writeTunnelPaused(w http.ResponseWriter) {
-	writeErrorPage(w, http.StatusServiceUnavailable, "Tunnel paused", "The owner has paused this tunnel. It will resume when they press R.")
+	writeErrorPage(w, "paused", http.StatusServiceUnavailable, "Tunnel paused", "The owner has paused this tunnel. It will resume when they press R.")
 }
 
 func writeInvalidSlug(w http.ResponseWriter) {
-	writeErrorPage(w, http.StatusNotFound, "Invalid wormhole link", "This link is invalid or the wormhole has expired.")
+	writeErrorPage(w, "invalid_slug", http.StatusNotFound, "Invalid wormhole link", "This link is invalid or the wormhole has expired.")
 }
 
 func writeLockedByOwner(w http.ResponseWriter) {
-	writeErrorPage(w, http.StatusUnauthorized, "Wormhole locked", "The owner has locked this wormhole. Ask them to unlock it.")
+	writeErrorPage(w, "locked", http.StatusUnauthorized, "Wormhole locked", "The owner has locked this wormhole. Ask them to unlock it.")
 }
 
 func writePasswordRequired(w http.ResponseWriter) {
-	writeErrorPage(w, http.StatusUnauthorized, "Password required", "This wormhole requires a password. Add <code>?wormkey_password=YOUR_PASSWORD</code> to the URL.")
+	writeErrorPage(w, "password", http.StatusUnauthorized, "Password required", "This wormhole requires a password. Add <code>?wormkey_password=YOUR_PASSWORD</code> to the URL.")
 }
 
 func writeViewerRemoved(w http.ResponseWriter) {
-	writeErrorPage(w, http.StatusForbidden, "Viewer removed", "You were removed by the owner.")
+	writeErrorPage(w, "removed", http.StatusForbidden, "Viewer removed", "You were removed by the owner.")
 }
 
 func writeTooManyViewers(w http.ResponseWriter) {
-	writeErrorPage(w, http.StatusTooManyRequests, "Too many viewers", "This wormhole has reached its viewer limit. Try again later.")
+	writeErrorPage(w, "too_many_viewers", http.StatusTooManyRequests, "Too many viewers", "This wormhole has reached its viewer limit. Try again later.")
 }
 
 func writePathBlocked(w http.ResponseWriter) {
-	writeErrorPage(w, http.StatusForbidden, "Path blocked", "The owner has blocked access to this path.")
+	writeErrorPage(w, "blocked_path", http.StatusForbidden, "Path blocked", "The owner has blocked access to this path.")
+}
+
+func writeNotHTTPTunnel(w http.ResponseWriter, mode string) {
+	m := strings.ToUpper(mode)
+	writeErrorPage(w, "not_http", http.StatusBadGateway, m+" wormhole", "This wormhole carries raw "+m+", not HTTP. Connect to its "+m+" address instead.")
 }
 
 func writeTunnelWriteFailed(w http.ResponseWriter) {
-	writeErrorPage(w, http.StatusBadGateway, "Connection lost", "The tunnel connection was lost. The owner may need to restart <code>wormkey</code>.")
-}
-
-func writeErrorPage(w http.ResponseWriter, status int, title, message string) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(status)
-	html := `<!DOCTYPE html>
-<html>
-<head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1"><title>` + title + `</title>
-<style>
-*{box-sizing:border-box}
-body{margin:0;font-family:ui-sans-serif,system-ui,sans-serif;background:#0f0f0f;color:#f4f4f4;min-height:100vh;display:flex;align-items:center;justify-content:center;padding:2rem}
-.wrap{text-align:center;max-width:28rem}
-h1{font-size:1.25rem;font-weight:600;margin:0 0 0.5rem}
-p{color:#a3a3a3;margin:0;line-height:1.6}
-code{background:#262626;padding:0.2em 0.4em;border-radius:4px;font-size:0.9em}
-a{color:#60a5fa;text-decoration:none}
-a:hover{text-decoration:underline}
-</style>
-</head>
-<body>
-<div class="wrap">
-` + mascotHTML + `
-<h1>` + title + `</h1>
-<p>` + message + `</p>
-<p style="margin-top:1.5rem"><a href="https://wormkey.run">wormkey.run</a></p>
-</div>
-</body>
-</html>`
-	_, _ = w.Write([]byte(html))
+	writeErrorPage(w, "connection_lost", http.StatusBadGateway, "Connection lost", "The tunnel connection was lost. The owner may need to restart <code>wormkey</code>.")
 }
 
 func setCookie(w http.ResponseWriter, name, value string, httpOnly bool) {
@@ -410,8 +451,9 @@ func hydrateFromControlPlane(controlPlaneURL, slug string, tc *tunnelConn) {
 	if tc.ownerToken == "" && sess.OwnerToken != "" {
 		tc.ownerToken = sess.OwnerToken
 	}
+	tc.session = sess.ref()
 	tc.policyMu.Lock()
-	if sess.Policy.MaxConcurrentViewers > 0 || sess.Policy.Public || len(sess.Policy.BlockPaths) > 0 || sess.Policy.Password != "" {
+	if sess.Policy.MaxConcurrentViewers > 0 || sess.Policy.Public || len(sess.Policy.BlockPaths) > 0 || sess.Policy.Password != "" || sess.Policy.Capture != nil || len(sess.Policy.Signatures) > 0 || sess.Policy.Cache != nil || len(sess.Policy.ErrorPages) > 0 {
 		tc.policy = sess.Policy
 	}
 	tc.policyMu.Unlock()
@@ -426,58 +468,62 @@ func hydrateFromControlPlane(controlPlaneURL, slug string, tc *tunnelConn) {
 	tc.viewerMu.Unlock()
 }
 
-func postJSON(url string, body any) {
+func postJSON(url string, body any) error {
 	b, err := json.Marshal(body)
 	if err != nil {
-		return
+		return err
 	}
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(b))
 	if err != nil {
-		return
+		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	signControlPlaneRequest(req, b)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return
+		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("control plane returned %d", resp.StatusCode)
+	}
+	return nil
 }
 
-func syncPolicy(controlPlaneURL, slug string, policy tunnelPolicy) {
+// syncToControlPlane posts body to /sessions/by-slug/<slug>/<op>, counting failures.
+func syncToControlPlane(controlPlaneURL, slug, op string, body any) {
 	if controlPlaneURL == "" {
 		return
 	}
-	url := strings.TrimRight(controlPlaneURL, "/") + "/sessions/by-slug/" + slug + "/policy"
-	postJSON(url, map[string]any{
+	url := strings.TrimRight(controlPlaneURL, "/") + "/sessions/by-slug/" + slug + "/" + op
+	if err := postJSON(url, body); err != nil {
+		metrics.syncFailures.Inc(op)
+	}
+}
+
+func syncPolicy(controlPlaneURL, slug string, policy tunnelPolicy) {
+	syncToControlPlane(controlPlaneURL, slug, "policy", map[string]any{
 		"public":               policy.Public,
 		"maxConcurrentViewers": policy.MaxConcurrentViewers,
 		"blockPaths":           policy.BlockPaths,
 		"password":             policy.Password,
+		"capture":              policy.Capture,
+		"signatures":           policy.Signatures,
+		"cache":                policy.Cache,
+		"errorPages":           policy.ErrorPages,
 	})
 }
 
 func syncViewers(controlPlaneURL, slug string, viewers []viewerState) {
-	if controlPlaneURL == "" {
-		return
-	}
-	url := strings.TrimRight(controlPlaneURL, "/") + "/sessions/by-slug/" + slug + "/viewers"
-	postJSON(url, map[string]any{"viewers": viewers})
+	syncToControlPlane(controlPlaneURL, slug, "viewers", map[string]any{"viewers": viewers})
 }
 
 func syncKick(controlPlaneURL, slug, viewerID string) {
-	if controlPlaneURL == "" {
-		return
-	}
-	url := strings.TrimRight(controlPlaneURL, "/") + "/sessions/by-slug/" + slug + "/kick"
-	postJSON(url, map[string]any{"viewerId": viewerID})
+	syncToControlPlane(controlPlaneURL, slug, "kick", map[string]any{"viewerId": viewerID})
 }
 
 func syncClose(controlPlaneURL, slug string) {
-	if controlPlaneURL == "" {
-		return
-	}
-	url := strings.TrimRight(controlPlaneURL, "/") + "/sessions/by-slug/" + slug + "/close"
-	postJSON(url, map[string]any{})
+	syncToControlPlane(controlPlaneURL, slug, "close", map[string]any{})
 }
 
 func main() {
@@ -485,6 +531,46 @@ func main() {
 	tunnels := sync.Map{} // slug string -> *tunnelConn
 	closedSlugs := sync.Map{}
 	controlPlaneURL := getEnv("WORMKEY_CONTROL_PLANE", "https://wormkey-control-plane.onrender.com")
+	controlPlaneSecret = getEnv("WORMKEY_CONTROL_PLANE_SECRET", "")
+	captures := newCaptureStore(getEnv("WORMKEY_CAPTURE_DIR", "data/capture"), controlPlaneURL)
+	go captures.sweepExpired()
+	for _, d := range splitList(getEnv("WORMKEY_BASE_DOMAINS", getEnv("WORMKEY_BASE_DOMAIN", "wormkey.run"))) {
+		if d = normalizeHostname(d); d != "" {
+			baseDomains = append(baseDomains, d)
+		}
+	}
+	if len(baseDomains) == 0 {
+		log.Fatal("WORMKEY_BASE_DOMAINS has no domains")
+	}
+	strictRouting = os.Getenv("WORMKEY_STRICT_ROUTING") == "true"
+	pathRouting = os.Getenv("WORMKEY_PATH_ROUTING") != "off"
+	if err := domains.load(getEnv("WORMKEY_DOMAINS_FILE", "data/domains.json")); err != nil {
+		log.Printf("domains: load: %v", err)
+	}
+	go domains.pruneExpired()
+	tcpPorts = newPortPool("tcp", os.Getenv("WORMKEY_TCP_PORTS"), getEnv("WORMKEY_TCP_HOST", baseDomains[0]), serveTCP)
+	if d, err := time.ParseDuration(os.Getenv("WORMKEY_UDP_IDLE_TIMEOUT")); err == nil && d > 0 {
+		udpIdleTimeout = d
+	}
+	if v := os.Getenv("WORMKEY_SSE_KEEPALIVE"); v == "off" {
+		sseKeepAlive = 0
+	} else if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		sseKeepAlive = d
+	}
+	upgrader.EnableCompression = os.Getenv("WORMKEY_TUNNEL_COMPRESSION") != "off"
+	if n, err := strconv.ParseInt(os.Getenv("WORMKEY_CACHE_TOTAL_BYTES"), 10, 64); err == nil && n > 0 {
+		cacheTotalMaxBytes = n
+	}
+	if n, err := strconv.ParseInt(os.Getenv("WORMKEY_CACHE_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		cacheMaxBytes = n
+	}
+	cacheMaxBytes = min(cacheMaxBytes, cacheTotalMaxBytes)
+	cacheMaxEntryBytes = min(cacheMaxEntryBytes, cacheMaxBytes)
+	udpPorts = newPortPool("udp", os.Getenv("WORMKEY_UDP_PORTS"), getEnv("WORMKEY_UDP_HOST", getEnv("WORMKEY_TCP_HOST", baseDomains[0])), serveUDP)
+	initTracing()
+	if controlPlaneSecret == "" {
+		log.Println("WORMKEY_CONTROL_PLANE_SECRET not set; control plane requests are unsigned")
+	}
 
 	mux := http.NewServeMux()
 
@@ -495,7 +581,7 @@ func main() {
 	})
 
 	// Tunnel websocket endpoint
-	mux.HandleFunc("/tunnel", handleTunnel(&tunnels, &closedSlugs, controlPlaneURL))
+	mux.HandleFunc("/tunnel", handleTunnel(&tunnels, &closedSlugs, controlPlaneURL, captures))
 
 	mux.HandleFunc("/.wormkey/overlay.js", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
@@ -520,10 +606,16 @@ func main() {
 			http.Error(w, "Invalid owner token", 401)
 			return
 		}
-		setCookie(w, "wormkey_slug", slug, false)
-		setCookie(w, "wormkey", slug, false)
+		if !strictRouting {
+			setCookie(w, "wormkey_slug", slug, false)
+			setCookie(w, "wormkey", slug, false)
+		}
 		setCookie(w, "wormkey_owner", token, true)
-		http.Redirect(w, r, "/s/"+slug, http.StatusFound)
+		if pathRouting {
+			http.Redirect(w, r, "/s/"+slug, http.StatusFound)
+		} else {
+			http.Redirect(w, r, "/", http.StatusFound)
+		}
 	})
 
 	mux.HandleFunc("/.wormkey/me", func(w http.ResponseWriter, r *http.Request) {
@@ -587,19 +679,43 @@ func main() {
 		policy := tc.policy
 		tc.policyMu.RUnlock()
 		viewers := tc.snapshotViewers()
+		errorPages := errorPageKinds(policy.ErrorPages)
+		policy.ErrorPages = nil // templates can be large; /.wormkey/error-pages has them
 		out := map[string]any{
-			"slug":            slug,
-			"owner":           true,
-			"activeViewers":   len(viewers),
-			"activeStreams":   tc.activeStreams.Load(),
-			"viewers":         viewers,
-			"kickedViewerIds": tc.kickedIDs(),
-			"policy":          policy,
+			"slug":             slug,
+			"owner":            true,
+			"activeViewers":    len(viewers),
+			"activeStreams":    tc.activeStreams.Load(),
+			"streamingStreams": tc.streamingStreams.Load(),
+			"viewers":          viewers,
+			"kickedViewerIds":  tc.kickedIDs(),
+			"policy":           policy,
+			"mode":             tc.mode,
+		}
+		if report := tc.overlay.Load(); report != nil {
+			out["overlay"] = report
+		}
+		if policy.Cache != nil && policy.Cache.Enabled {
+			out["cache"] = tc.cache.stats()
+		}
+		if len(errorPages) > 0 {
+			out["errorPages"] = errorPages
+		}
+		if addr := portPoolFor(tc.mode).addrFor(slug); addr != "" {
+			out[tc.mode+"Address"] = addr
+		} else if tc.mode == "tls" {
+			out["tlsAddress"] = passthroughPublicAddr(slug)
 		}
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(out)
 	})
 
+	mux.HandleFunc("/.wormkey/domains", handleDomains(&tunnels))
+	mux.HandleFunc("/.wormkey/domains/verify", handleDomains(&tunnels))
+	mux.HandleFunc("/.wormkey/requests", handleInspectorList(&tunnels))
+	mux.HandleFunc("/.wormkey/requests/live", handleInspectorLive(&tunnels))
+	mux.HandleFunc("/.wormkey/replay", handleReplay(&tunnels))
+
 	mux.HandleFunc("/.wormkey/policy", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", 405)
@@ -621,6 +737,16 @@ func main() {
 			http.Error(w, "Invalid JSON", 400)
 			return
 		}
+		for i := range patch.Signatures {
+			if err := patch.Signatures[i].normalize(); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		if err := prepareErrorPages(patch.ErrorPages); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
 		tc.policyMu.Lock()
 		if patch.Public != nil {
 			tc.policy.Public = *patch.Public
@@ -631,6 +757,21 @@ func main() {
 		if patch.BlockPaths != nil {
 			tc.policy.BlockPaths = patch.BlockPaths
 		}
+		if patch.Capture != nil {
+			tc.policy.Capture = patch.Capture
+		}
+		if patch.Signatures != nil {
+			tc.policy.Signatures = patch.Signatures
+		}
+		if patch.ErrorPages != nil {
+			tc.policy.ErrorPages = patch.ErrorPages
+		}
+		if patch.Cache != nil {
+			tc.policy.Cache = patch.Cache
+			if !patch.Cache.Enabled {
+				tc.cache.purge("")
+			}
+		}
 		policy := tc.policy
 		tc.policyMu.Unlock()
 		go syncPolicy(controlPlaneURL, slug, policy)
@@ -663,6 +804,8 @@ func main() {
 		tc.kickedViewers[viewerID] = struct{}{}
 		delete(tc.viewers, viewerID)
 		tc.viewerMu.Unlock()
+		tc.closeTCPViewer(viewerID)
+		tc.closeUDPViewer(viewerID)
 		go syncKick(controlPlaneURL, slug, viewerID)
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "viewerId": viewerID})
@@ -694,6 +837,28 @@ func main() {
 		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "password": pw})
 	})
 
+	mux.HandleFunc("/.wormkey/error-pages", handleErrorPages(&tunnels, controlPlaneURL))
+	mux.HandleFunc("/.wormkey/purge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		slug := resolveSlug(r)
+		val, ok := tunnels.Load(slug)
+		if !ok {
+			http.Error(w, "Tunnel not connected", 503)
+			return
+		}
+		tc := val.(*tunnelConn)
+		if !isOwner(r, tc) {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		purged := tc.cache.purge(r.URL.Query().Get("prefix"))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "purged": purged})
+	})
+
 	mux.HandleFunc("/.wormkey/close", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", 405)
@@ -712,6 +877,12 @@ func main() {
 		}
 		tunnels.Delete(slug)
 		closedSlugs.Store(slug, struct{}{})
+		captures.forget(slug, tc.session)
+		if _, reserved := reservedSlugs.Load(slug); !reserved {
+			domains.removeSlug(slug) // reserved slugs keep their domains until released
+		}
+		tcpPorts.releaseNow(slug)
+		udpPorts.releaseNow(slug)
 		go syncClose(controlPlaneURL, slug)
 		_ = tc.conn.Close()
 		w.Header().Set("Content-Type", "application/json")
@@ -719,20 +890,94 @@ func main() {
 	})
 
 	// Everything else proxies to tunnel (or shows "not connected" when no slug)
-	mux.HandleFunc("/", handleProxy(&tunnels, controlPlaneURL))
+	mux.HandleFunc("/", handleProxy(&tunnels, controlPlaneURL, captures))
+
+	// Prometheus scrape endpoint on its own listener so it is never exposed via wormhole hosts
+	if metricsAddr := getEnv("WORMKEY_METRICS_ADDR", ":9091"); metricsAddr != "off" {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("/metrics", handleMetrics(&tunnels))
+		go func() {
+			log.Println("metrics listening on", metricsAddr)
+			if err := http.ListenAndServe(metricsAddr, metricsMux); err != nil {
+				log.Printf("metrics listener: %v", err)
+			}
+		}()
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3002" // local fallback only
 	}
 	addr := "0.0.0.0:" + port
-	log.Println("listening on", addr)
-	log.Fatal(http.ListenAndServe(addr, mux))
+	certs, err := tlsFromEnv()
+	if err != nil {
+		log.Fatalf("tls: %v", err)
+	}
+	tlsAddr := getEnv("WORMKEY_TLS_ADDR", ":443")
+	passthroughAddr = os.Getenv("WORMKEY_PASSTHROUGH_ADDR")
+	if passthroughAddr != "" && (certs == nil || passthroughAddr != tlsAddr) {
+		go servePassthrough(&tunnels)
+	}
+	// Plain listeners also speak h2c (prior knowledge or Upgrade: h2c) unless disabled.
+	var plainMux http.Handler = mux
+	if os.Getenv("WORMKEY_H2C") != "off" {
+		plainMux = h2c.NewHandler(mux, &http2.Server{})
+	}
+	if certs == nil {
+		log.Println("listening on", addr)
+		log.Fatal(http.ListenAndServe(addr, plainMux))
+	}
+
+	hstsMaxAge, _ := strconv.Atoi(getEnv("WORMKEY_HSTS_MAX_AGE", "31536000"))
+	var handler http.Handler = mux
+	if hstsMaxAge > 0 {
+		handler = withHSTS(mux, hstsMaxAge, os.Getenv("WORMKEY_HSTS_INCLUDE_SUBDOMAINS") == "true")
+	}
+	go func() {
+		// Plain HTTP: redirect to HTTPS, or keep serving everything when redirects are off
+		// (e.g. behind a TLS-terminating load balancer during migration).
+		var plain http.Handler = redirectToHTTPS(tlsAddr)
+		if os.Getenv("WORMKEY_TLS_REDIRECT") == "off" {
+			plain = plainMux
+		}
+		plain = certs.serveHTTP01(plain)
+		log.Println("listening on", addr)
+		if err := http.ListenAndServe(addr, plain); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	server := &http.Server{
+		Addr:      tlsAddr,
+		Handler:   handler,
+		TLSConfig: &tls.Config{GetCertificate: certs.getCertificate, MinVersion: tls.VersionTLS12},
+	}
+	if passthroughAddr != tlsAddr {
+		log.Println("listening (TLS) on", tlsAddr)
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	ln, err := net.Listen("tcp", tlsAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("listening (TLS + passthrough) on", tlsAddr)
+	log.Fatal(server.ServeTLS(newSNIListener(ln, &tunnels, true), "", ""))
+}
+
+func (tc *tunnelConn) writeFrame(data []byte) error { return tc.write(data, false) }
+
+// writeCompressible sends a frame deflated if the tunnel negotiated compression and the
+// frame is big enough to benefit.
+func (tc *tunnelConn) writeCompressible(data []byte) error {
+	return tc.write(data, len(data) >= minCompressSize)
 }
 
-func (tc *tunnelConn) writeFrame(data []byte) error {
+func (tc *tunnelConn) write(data []byte, compress bool) error {
 	tc.writeMu.Lock()
 	defer tc.writeMu.Unlock()
+	if len(data) > 0 {
+		metrics.frames.Inc(frameTypeName(data[0]), "out")
+	}
+	tc.conn.EnableWriteCompression(compress)
 	return tc.conn.WriteMessage(websocket.BinaryMessage, data)
 }
 
@@ -743,7 +988,7 @@ func getEnv(k, d string) string {
 	return d
 }
 
-func handleTunnel(tunnels *sync.Map, closedSlugs *sync.Map, controlPlaneURL string) http.HandlerFunc {
+func handleTunnel(tunnels *sync.Map, closedSlugs *sync.Map, controlPlaneURL string, captures *captureStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Upgrade") != "websocket" {
 			http.Error(w, "WebSocket required", 400)
@@ -766,6 +1011,15 @@ func handleTunnel(tunnels *sync.Map, closedSlugs *sync.Map, controlPlaneURL stri
 		if len(slug) > 64 {
 			slug = slug[:64]
 		}
+		reserved, status, msg := authorizeReservedSlug(controlPlaneURL, slug, ownerToken)
+		if status != 0 {
+			log.Printf("Tunnel rejected for reserved slug %s: %s", slug, msg)
+			http.Error(w, msg, status)
+			return
+		}
+		if reserved {
+			closedSlugs.Delete(slug) // every run of a reserved slug is a new session
+		}
 		if _, closed := closedSlugs.Load(slug); closed {
 			http.Error(w, "Session closed", http.StatusGone)
 			return
@@ -781,14 +1035,40 @@ func handleTunnel(tunnels *sync.Map, closedSlugs *sync.Map, controlPlaneURL stri
 				return
 			}
 		}
-		conn, err := upgrader.Upgrade(w, r, nil)
+		mode := "http"
+		var respHeader http.Header
+		if m := r.Header.Get(tunnelModeHeader); m == "tls" {
+			if passthroughAddr == "" {
+				http.Error(w, "TLS passthrough is not enabled on this gateway", http.StatusNotImplemented)
+				return
+			}
+			mode = m
+			respHeader = http.Header{publicAddrHeaders[m]: {passthroughPublicAddr(slug)}}
+		} else if m == "tcp" || m == "udp" {
+			pool := portPoolFor(m)
+			if pool == nil {
+				http.Error(w, strings.ToUpper(m)+" tunnels are not enabled on this gateway", http.StatusNotImplemented)
+				return
+			}
+			ep, err := pool.bind(tunnels, slug)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			mode = m
+			respHeader = http.Header{publicAddrHeaders[m]: {pool.publicAddr(ep)}}
+		}
+		conn, err := upgrader.Upgrade(w, r, respHeader)
 		if err != nil {
 			log.Printf("Upgrade error: %v", err)
 			return
 		}
-		tc := &tunnelConn{conn: conn, slug: slug, ownerToken: ownerToken, viewers: map[string]*viewerState{}, kickedViewers: map[string]struct{}{}}
+		tc := &tunnelConn{conn: conn, slug: slug, ownerToken: ownerToken, viewers: map[string]*viewerState{}, kickedViewers: map[string]struct{}{}, inspector: newRequestInspector(), cache: newEdgeCache(), closed: make(chan struct{}), mode: mode}
 		tc.policy = tunnelPolicy{Public: true, MaxConcurrentViewers: 20}
 		hydrateFromControlPlane(controlPlaneURL, slug, tc)
+		if account, ok := reservedSlugs.Load(slug); ok && reserved {
+			domains.adopt(slug, tc.session, account.(string))
+		}
 		if existing, ok := tunnels.Load(slug); ok {
 			if prev, okPrev := existing.(*tunnelConn); okPrev && prev != tc {
 				_ = prev.conn.Close()
@@ -796,14 +1076,27 @@ func handleTunnel(tunnels *sync.Map, closedSlugs *sync.Map, controlPlaneURL stri
 		}
 		tunnels.Store(slug, tc)
 		defer func() {
+			close(tc.closed)
+			tc.cache.release()
 			if current, ok := tunnels.Load(slug); ok {
 				if active, okActive := current.(*tunnelConn); okActive && active == tc {
 					tunnels.Delete(slug)
+					tc.policyMu.RLock()
+					captures.remember(slug, tc.session, tc.policy)
+					tc.policyMu.RUnlock()
+					if pool := portPoolFor(mode); pool != nil {
+						pool.releaseLater(tunnels, slug)
+					}
 				}
 			}
 			conn.Close()
 		}()
+		metrics.tunnelConnections.Inc()
 		log.Printf("Tunnel connected: %s", slug)
+		go captures.deliver(tc)
+		if mode == "udp" {
+			go tc.expireUDPFlows()
+		}
 		for {
 			_, data, err := conn.ReadMessage()
 			if err != nil {
@@ -815,6 +1108,13 @@ func handleTunnel(tunnels *sync.Map, closedSlugs *sync.Map, controlPlaneURL stri
 			ftype := data[0]
 			streamID := binary.BigEndian.Uint32(data[1:5])
 			payload := data[5:]
+			metrics.frames.Inc(frameTypeName(ftype), "in")
+			if (mode == "tcp" || mode == "tls") && tc.handleTCPFrame(ftype, streamID, payload) {
+				continue
+			}
+			if mode == "udp" && tc.handleUDPFrame(ftype, streamID, payload) {
+				continue
+			}
 			switch ftype {
 			case FramePing:
 				pong := make([]byte, 5)
@@ -827,189 +1127,516 @@ func handleTunnel(tunnels *sync.Map, closedSlugs *sync.Map, controlPlaneURL stri
 			case FrameResume:
 				tc.paused.Store(false)
 			case FrameResponseHdrs:
-				if ctx, ok := tc.streams.Load(streamID); ok {
-					sc := ctx.(*streamCtx)
-					lines := bytes.Split(payload, []byte("\r\n"))
-					if len(lines) > 0 {
-						status := 200
-						parts := bytes.SplitN(lines[0], []byte(" "), 3)
-						if len(parts) >= 2 {
-							fmt.Sscanf(string(parts[1]), "%d", &status)
+				if sc := tc.lockStream(streamID); sc != nil {
+					if status, header, ok := parseResponseHeaders(payload); ok {
+						if sc.fill != nil && sc.fill.headers(status, header) {
+							// 304 to the gateway's own revalidation: the handler serves the cached copy.
+							sc.trace.headersReceived(status)
+							sc.mu.Unlock()
+							continue
 						}
-						for i := 1; i < len(lines); i++ {
-							line := lines[i]
-							if len(line) == 0 {
-								break
-							}
-							colon := bytes.IndexByte(line, ':')
-							if colon > 0 {
-								k := string(bytes.TrimSpace(line[:colon]))
-								v := string(bytes.TrimSpace(line[colon+1:]))
-								sc.w.Header().Set(k, v)
-							}
+						for k, v := range header {
+							sc.w.Header()[k] = v
 						}
 						if sc.setCookie != "" {
 							// wormkey_slug ensures asset requests (/_next/..., /assets/...) route correctly
 							sc.w.Header().Add("Set-Cookie", "wormkey_slug="+sc.setCookie+"; Path=/; SameSite=Lax")
 						}
+						sc.trace.headersReceived(status)
+						sc.wroteHdr = true
+						if isStreamingResponse(sc.w.Header()) {
+							tc.startStreaming(sc)
+						}
 						sc.w.WriteHeader(status)
-						if sc.flusher != nil {
+						// A gRPC Trailers-Only response must go out as one HEADERS frame with
+						// END_STREAM, so it is not flushed ahead of STREAM_END.
+						trailersOnly := sc.grpc && sc.w.Header().Get("Grpc-Status") != ""
+						if sc.flusher != nil && !trailersOnly {
 							sc.flusher.Flush()
 						}
 					}
+					sc.mu.Unlock()
 				}
 			case FrameStreamData:
-				if ctx, ok := tc.streams.Load(streamID); ok {
-					sc := ctx.(*streamCtx)
-					sc.w.Write(payload)
-					if sc.flusher != nil {
-						sc.flusher.Flush()
+				if sc := tc.lockStream(streamID); sc != nil {
+					sc.trace.data(len(payload))
+					if sc.fill != nil {
+						sc.fill.write(payload)
+					}
+					if _, err := sc.w.Write(payload); errors.Is(err, errRecodeFailed) {
+						tc.endStream(streamID, sc, true)
+						_ = tc.writeFrame(makeFrame(FrameStreamCancel, streamID, nil))
+					} else {
+						if sc.flusher != nil {
+							sc.flusher.Flush()
+						}
+						if len(payload) > 0 {
+							sc.lastWrite = time.Now()
+							sc.lineStart = payload[len(payload)-1] == '\n'
+						}
 					}
+					sc.mu.Unlock()
 				}
 			case FrameStreamEnd:
-				if ctx, ok := tc.streams.LoadAndDelete(streamID); ok {
-					sc := ctx.(*streamCtx)
-					if iw, ok := sc.w.(*overlayInjectWriter); ok {
-						iw.FlushInject()
+				if sc := tc.lockStream(streamID); sc != nil {
+					tc.endStream(streamID, sc, false)
+					sc.mu.Unlock()
+				}
+			case FrameResponseTrls:
+				if sc := tc.lockStream(streamID); sc != nil {
+					if sc.fill != nil {
+						sc.fill.abandon()
 					}
-					tc.activeStreams.Add(-1)
-					close(sc.done)
+					writeTrailers(sc.w, payload)
+					sc.mu.Unlock()
 				}
 			case FrameStreamCancel:
-				if ctx, ok := tc.streams.LoadAndDelete(streamID); ok {
-					tc.activeStreams.Add(-1)
-					close(ctx.(*streamCtx).done)
+				if sc := tc.lockStream(streamID); sc != nil {
+					if sc.grpc && sc.wroteHdr {
+						setGRPCTrailerStatus(sc.w, grpcUnavailable, "stream cancelled by the tunnel client")
+					} else if sc.grpc {
+						writeGRPCStatus(sc.w, grpcUnavailable, "stream cancelled by the tunnel client")
+					}
+					tc.endStream(streamID, sc, true)
+					sc.mu.Unlock()
 				}
 			}
 		}
 	}
 }
 
-func handleProxy(tunnels *sync.Map, controlPlaneURL string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		slugFromPath := strings.HasPrefix(r.URL.Path, "/s/")
+func handleProxy(tunnels *sync.Map, controlPlaneURL string, captures *captureStore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: rw, body: newCappedBuffer(inspectorBodyLimit), grpc: isGRPC(r), acceptJSON: acceptsJSON(r)}
+		reqBody := newCappedBuffer(inspectorBodyLimit)
+		var inspector *requestInspector
+		entry := &accessEntry{requestID: newRequestID()}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "gateway.request", trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), attribute.String("wormkey.request_id", entry.requestID)))
+		defer func() {
+			d := time.Since(start)
+			rec.observe(d)
+			logAccess(r, entry, rec, d)
+			if inspector != nil {
+				inspector.record(inspect(r, entry, rec, reqBody, start, d))
+			}
+			span.SetAttributes(
+				semconv.URLPath(r.URL.Path),
+				semconv.HTTPResponseStatusCode(rec.statusCode()),
+				attribute.String("wormkey.slug", entry.slug),
+				attribute.Bool("wormkey.owner", entry.owner),
+			)
+			if entry.rejection != "" {
+				span.SetAttributes(attribute.String("wormkey.rejection", entry.rejection))
+			}
+			if rec.statusCode() >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(rec.statusCode()))
+			}
+			span.End()
+		}()
+		w := http.ResponseWriter(rec)
+		w.Header().Set(requestIDHeader, entry.requestID)
+		reject := func(reason string) {
+			entry.rejection = reason
+			metrics.policyRejections.Inc(reason)
+		}
+		slugFromPath := pathRouting && strings.HasPrefix(r.URL.Path, "/s/")
 		slug := resolveSlug(r)
+		entry.slug = slug
 		if slug == "" {
+			entry.rejection = "invalid_slug"
 			writeInvalidSlug(w)
 			return
 		}
 		val, ok := tunnels.Load(slug)
 		if !ok {
+			if p, session := captures.offlinePolicy(slug); p != nil {
+				rec.errorPages = p.ErrorPages
+				if p.Capture != nil && p.Capture.Enabled {
+					// Queued requests reach localhost later, so they pass the same checks now.
+					if reason := checkViewerAccess(w, r, *p); reason != "" {
+						reject(reason)
+						return
+					}
+					if rule := matchSignatureRule(p.Signatures, r.URL.Path); rule != nil {
+						if _, err := verifyRequestSignature(r, rule); err != nil {
+							reject("bad_signature")
+							entry.detail = err.Error()
+							writeSignatureInvalid(w)
+							return
+						}
+					}
+					if captures.capture(w, r, session, p.Capture, entry.requestID) {
+						entry.rejection = "captured_offline"
+						return
+					}
+				}
+			}
+			entry.rejection = "not_active"
 			writeWormholeNotActive(w)
 			return
 		}
 		tc := val.(*tunnelConn)
+		if tc.mode != "http" {
+			entry.rejection = tc.mode + "_tunnel"
+			writeNotHTTPTunnel(w, tc.mode)
+			return
+		}
+		inspector = tc.inspector
+		tc.policyMu.RLock()
+		policy := tc.policy
+		tc.policyMu.RUnlock()
+		rec.errorPages = policy.ErrorPages
 		owner := isOwner(r, tc)
+		entry.owner = owner
 		viewerID := ""
 		if !owner {
 			viewerID = getViewerID(w, r)
+			entry.viewerID = viewerID
 			tc.viewerMu.RLock()
 			_, kicked := tc.kickedViewers[viewerID]
 			tc.viewerMu.RUnlock()
 			if kicked {
+				reject("kicked")
 				writeViewerRemoved(w)
 				return
 			}
 			tc.upsertViewer(viewerID, r.RemoteAddr)
 			go syncViewers(controlPlaneURL, slug, tc.snapshotViewers())
 		}
-		tc.policyMu.RLock()
-		policy := tc.policy
-		tc.policyMu.RUnlock()
-		if !policy.Public && !owner {
-			writeLockedByOwner(w)
-			return
-		}
-		if !owner && policy.Password != "" {
-			password := ""
-			if c, err := r.Cookie("wormkey_pass"); err == nil {
-				password = c.Value
-			}
-			if qp := r.URL.Query().Get("wormkey_password"); qp != "" {
-				password = qp
-				setCookie(w, "wormkey_pass", qp, true)
-			}
-			if password != policy.Password {
-				writePasswordRequired(w)
+		if !owner {
+			if reason := checkViewerAccess(w, r, policy); reason != "" {
+				reject(reason)
 				return
 			}
 		}
 		if !owner && policy.MaxConcurrentViewers > 0 && len(tc.snapshotViewers()) >= policy.MaxConcurrentViewers {
+			reject("too_many_viewers")
 			writeTooManyViewers(w)
 			return
 		}
-		if !owner && len(policy.BlockPaths) > 0 {
-			for _, p := range policy.BlockPaths {
-				if p != "" && strings.HasPrefix(r.URL.Path, p) {
-					writePathBlocked(w)
-					return
-				}
-			}
-		}
 		if !owner && tc.paused.Load() {
+			reject("paused")
 			writeTunnelPaused(w)
 			return
 		}
-		streamID := tc.streamID.Add(1)
-		var buf bytes.Buffer
-		fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", r.Method, r.URL.RequestURI())
-		r.Header.Write(&buf)
-		buf.WriteString("\r\n")
-		frame := make([]byte, 5+buf.Len())
-		frame[0] = FrameOpenStream
-		binary.BigEndian.PutUint32(frame[1:5], streamID)
-		copy(frame[5:], buf.Bytes())
-		if err := tc.writeFrame(frame); err != nil {
-			writeTunnelWriteFailed(w)
-			return
+		if rule := matchSignatureRule(policy.Signatures, r.URL.Path); rule != nil {
+			if body, err := verifyRequestSignature(r, rule); err != nil {
+				reqBody.Write(body)
+				reject("bad_signature")
+				entry.detail = err.Error()
+				writeSignatureInvalid(w)
+				return
+			}
 		}
-		done := make(chan struct{})
-		flusher, _ := w.(http.Flusher)
+		r.Header.Set(requestIDHeader, entry.requestID)
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
 		setCookie := ""
-		if slugFromPath || r.URL.Query().Get("slug") != "" || extractSlugFromHost(r.Host) == slug {
+		if !strictRouting && (slugFromPath || r.URL.Query().Get("slug") != "" || extractSlugFromHost(r.Host) == slug) {
 			setCookie = slug
 		}
-		respW := http.ResponseWriter(w)
-		if owner {
-			respW = &overlayInjectWriter{w: w, slug: slug}
-		}
-		tc.activeStreams.Add(1)
-		tc.streams.Store(streamID, &streamCtx{w: respW, done: done, flusher: flusher, setCookie: setCookie})
-		sendStreamEnd := func() {
-			f := make([]byte, 5)
-			f[0] = FrameStreamEnd
-			binary.BigEndian.PutUint32(f[1:5], streamID)
-			tc.writeFrame(f)
-		}
-		if r.Body != nil && r.ContentLength != 0 {
-			go func() {
-				defer r.Body.Close()
-				br := bufio.NewReader(r.Body)
-				for {
-					chunk := make([]byte, 32*1024)
-					n, err := br.Read(chunk)
-					if n > 0 {
-						f := make([]byte, 5+n)
-						f[0] = FrameStreamData
-						binary.BigEndian.PutUint32(f[1:5], streamID)
-						copy(f[5:], chunk[:n])
-						tc.writeFrame(f)
-					}
-					if err == io.EOF {
-						break
+		var fill *cacheFill
+		fwd := r
+		if !owner && policy.Cache.covers(r.URL.Path) && cacheableRequest(r) {
+			cached := tc.cache.lookup(r)
+			if cached != nil && cached.fresh(time.Now()) && !requestNoCache(r) {
+				tc.cache.hits.Add(1)
+				metrics.edgeCache.Inc("hit")
+				serveCached(w, r, cached, "HIT", setCookie)
+				return
+			}
+			tc.cache.misses.Add(1)
+			fill = &cacheFill{cache: tc.cache, req: r, stale: cached}
+			fwd = fill.revalidation(r)
+			w.Header().Set(cacheStatusHeader, "MISS")
+		}
+		streamID, err := tc.forwardStream(ctx, w, fwd, streamOptions{
+			setCookie: setCookie,
+			inject:    owner,
+			onBody: func(p []byte) {
+				rec.bytesIn.Add(int64(len(p)))
+				reqBody.Write(p)
+			},
+			cache: fill,
+		})
+		entry.streamID = streamID
+		span.SetAttributes(attribute.Int64("wormkey.stream_id", int64(streamID)))
+		if fill != nil {
+			if err == nil && fill.revalidated != nil {
+				metrics.edgeCache.Inc("revalidated")
+				serveCached(w, r, fill.revalidated, "REVALIDATED", setCookie)
+				return
+			}
+			metrics.edgeCache.Inc("miss")
+		}
+		if errors.Is(err, errRecodeFailed) {
+			// Part of a rewritten page went out; a clean end would pass off the rest as complete.
+			entry.rejection = "overlay_failed"
+			panic(http.ErrAbortHandler)
+		}
+		if err != nil && err != errViewerGone {
+			entry.rejection = "tunnel_write_failed"
+			if rec.status == 0 {
+				writeTunnelWriteFailed(w)
+			} else if rec.grpc {
+				setGRPCTrailerStatus(w, grpcUnavailable, "tunnel connection lost")
+			}
+		}
+	}
+}
+
+// checkViewerAccess applies the lock, password and blocked-path rules of policy to a
+// viewer request. It writes the rejection page and returns the reason, or "" if r may
+// proceed.
+func checkViewerAccess(w http.ResponseWriter, r *http.Request, policy tunnelPolicy) string {
+	if !policy.Public {
+		writeLockedByOwner(w)
+		return "locked"
+	}
+	if policy.Password != "" {
+		password := ""
+		if c, err := r.Cookie("wormkey_pass"); err == nil {
+			password = c.Value
+		}
+		if qp := r.URL.Query().Get("wormkey_password"); qp != "" {
+			password = qp
+			setCookie(w, "wormkey_pass", qp, true)
+		}
+		if password != policy.Password {
+			writePasswordRequired(w)
+			return "password"
+		}
+	}
+	for _, p := range policy.BlockPaths {
+		if p != "" && strings.HasPrefix(r.URL.Path, p) {
+			writePathBlocked(w)
+			return "blocked_path"
+		}
+	}
+	return ""
+}
+
+var (
+	errTunnelClosed = errors.New("tunnel closed")
+	errViewerGone   = errors.New("viewer disconnected")
+)
+
+type streamOptions struct {
+	setCookie string         // slug for the wormkey_slug cookie, if the request routed by path/query/host
+	inject    bool           // inject the owner overlay into HTML responses
+	onBody    func(p []byte) // observes request body chunks as they are sent
+	cache     *cacheFill     // stores the response in the edge cache
+}
+
+// forwardStream opens a stream for r on the tunnel, pumps the request body and blocks
+// until the CLI ends the stream (the response is written to w by the tunnel read loop).
+// It returns errTunnelClosed if the tunnel goes away first, and errViewerGone (after
+// sending STREAM_CANCEL) if the viewer disconnects first.
+func (tc *tunnelConn) forwardStream(ctx context.Context, w http.ResponseWriter, r *http.Request, opts streamOptions) (uint32, error) {
+	streamID := tc.streamID.Add(1)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s\r\n", r.Method, r.URL.RequestURI(), r.Proto)
+	r.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	frame := make([]byte, 5+buf.Len())
+	frame[0] = FrameOpenStream
+	binary.BigEndian.PutUint32(frame[1:5], streamID)
+	copy(frame[5:], buf.Bytes())
+	done := make(chan struct{})
+	respW := w
+	if opts.inject {
+		respW = &overlayInjectWriter{w: w, tc: tc, path: r.URL.Path, host: r.Host, https: r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")}
+	}
+	flusher, _ := respW.(http.Flusher)
+	sc := &streamCtx{w: respW, done: done, flusher: flusher, setCookie: opts.setCookie, trace: startStreamTrace(ctx, streamID), grpc: isGRPC(r), lineStart: true, fill: opts.cache}
+	// Register before OPEN_STREAM goes out so a fast RESPONSE_HEADERS is never dropped.
+	tc.activeStreams.Add(1)
+	tc.streams.Store(streamID, sc)
+	_, writeSpan := tracer.Start(ctx, "tunnel.write_open_stream")
+	// Headers carry cookies and tokens, so they never share a deflate context with bodies.
+	err := tc.writeFrame(frame)
+	writeSpan.End()
+	if err != nil {
+		sc.mu.Lock()
+		if !sc.ended {
+			tc.endStream(streamID, sc, true)
+		}
+		sc.mu.Unlock()
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return streamID, err
+	}
+	sendStreamEnd := func() {
+		f := make([]byte, 5)
+		f[0] = FrameStreamEnd
+		binary.BigEndian.PutUint32(f[1:5], streamID)
+		tc.writeFrame(f)
+	}
+	if r.Body != nil && r.ContentLength != 0 {
+		compress := compressibleBody(r.Header)
+		go func() {
+			defer r.Body.Close()
+			br := bufio.NewReader(r.Body)
+			for {
+				chunk := make([]byte, 32*1024)
+				n, err := br.Read(chunk)
+				if n > 0 {
+					if opts.onBody != nil {
+						opts.onBody(chunk[:n])
 					}
-					if err != nil {
-						break
+					f := make([]byte, 5+n)
+					f[0] = FrameStreamData
+					binary.BigEndian.PutUint32(f[1:5], streamID)
+					copy(f[5:], chunk[:n])
+					if compress {
+						tc.writeCompressible(f)
+					} else {
+						tc.writeFrame(f)
 					}
 				}
-				sendStreamEnd()
-			}()
-		} else {
-			if r.Body != nil {
-				r.Body.Close()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					break
+				}
 			}
 			sendStreamEnd()
+		}()
+	} else {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		sendStreamEnd()
+	}
+	select {
+	case <-done:
+		if sc.aborted {
+			return streamID, errRecodeFailed
+		}
+		return streamID, nil
+	case <-tc.closed:
+		err = errTunnelClosed
+	case <-r.Context().Done():
+		err = errViewerGone
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.ended {
+		return streamID, nil
+	}
+	tc.endStream(streamID, sc, true)
+	if err == errViewerGone {
+		_ = tc.writeFrame(makeFrame(FrameStreamCancel, streamID, nil))
+	}
+	return streamID, err
+}
+
+// lockStream returns the stream with its lock held, or nil if it has ended.
+func (tc *tunnelConn) lockStream(streamID uint32) *streamCtx {
+	v, ok := tc.streams.Load(streamID)
+	if !ok {
+		return nil
+	}
+	sc := v.(*streamCtx)
+	sc.mu.Lock()
+	if sc.ended {
+		sc.mu.Unlock()
+		return nil
+	}
+	return sc
+}
+
+// endStream retires a stream exactly once and releases its handler. The caller holds sc.mu.
+func (tc *tunnelConn) endStream(streamID uint32, sc *streamCtx, cancelled bool) {
+	sc.ended = true
+	tc.streams.Delete(streamID)
+	if iw, ok := sc.w.(*overlayInjectWriter); ok {
+		sc.aborted = errors.Is(iw.close(!cancelled), errRecodeFailed)
+	}
+	if sc.fill != nil {
+		sc.fill.finish(!cancelled && !sc.aborted)
+	}
+	sc.trace.end(cancelled || sc.aborted)
+	if sc.streaming {
+		tc.streamingStreams.Add(-1)
+	} else {
+		tc.activeStreams.Add(-1)
+	}
+	close(sc.done)
+}
+
+// parseResponseHeaders parses a RESPONSE_HEADERS payload (status line and header lines).
+// A repeated header keeps its last value.
+func parseResponseHeaders(payload []byte) (status int, h http.Header, ok bool) {
+	lines := bytes.Split(payload, []byte("\r\n"))
+	if len(lines) == 0 {
+		return 0, nil, false
+	}
+	status = 200
+	parts := bytes.SplitN(lines[0], []byte(" "), 3)
+	if len(parts) >= 2 {
+		fmt.Sscanf(string(parts[1]), "%d", &status)
+	}
+	h = http.Header{}
+	for _, line := range lines[1:] {
+		if len(line) == 0 {
+			break
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon > 0 {
+			h.Set(string(bytes.TrimSpace(line[:colon])), string(bytes.TrimSpace(line[colon+1:])))
+		}
+	}
+	removeHopByHop(h)
+	return status, h, true
+}
+
+// hopByHopHeaders describe the local app's connection to the CLI, not the viewer's. HTTP/2
+// forbids them, and browsers reset streams that carry them.
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// removeHopByHop drops connection-specific headers and any header named in Connection.
+func removeHopByHop(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// forbiddenTrailers are fields that may not appear in trailers (framing, routing and
+// connection control); they are dropped rather than forwarded.
+var forbiddenTrailers = map[string]bool{
+	"Content-Length": true, "Transfer-Encoding": true, "Trailer": true, "Host": true,
+	"Connection": true, "Keep-Alive": true, "Te": true, "Upgrade": true, "Content-Type": true,
+}
+
+// writeTrailers applies a RESPONSE_TRAILERS payload to w with http.TrailerPrefix, so
+// trailers reach the viewer whether or not the response declared them in a Trailer header.
+// Trailers of an HTML response rewritten by the overlay no longer describe its body and
+// are dropped.
+func writeTrailers(w http.ResponseWriter, payload []byte) {
+	if iw, ok := w.(*overlayInjectWriter); ok && iw.inject {
+		return
+	}
+	for _, line := range bytes.Split(payload, []byte("\r\n")) {
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		k := http.CanonicalHeaderKey(string(bytes.TrimSpace(line[:colon])))
+		if forbiddenTrailers[k] {
+			continue
 		}
-		<-done
+		w.Header().Add(http.TrailerPrefix+k, string(bytes.TrimSpace(line[colon+1:])))
 	}
 }
@@ -0,0 +1,327 @@
+// Prometheus metrics for the gateway (text exposition format, no client library).
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are upper bounds in seconds for request duration histograms.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64 // joined label values -> count
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+func (c *counterVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, non-cumulative; last slot is +Inf
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hist
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	hist.counts[i]++
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(le)), cum)
+		}
+		cum += hist.counts[len(h.buckets)]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), cum)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), hist.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names []string, joined, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		values := strings.Split(joined, "\xff")
+		for i, n := range names {
+			v := ""
+			if i < len(values) {
+				v = values[i]
+			}
+			pairs = append(pairs, n+`="`+escapeLabelValue(v)+`"`)
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type gatewayMetrics struct {
+	requests               *counterVec
+	requestDuration        *histogramVec
+	bytes                  *counterVec
+	frames                 *counterVec
+	policyRejections       *counterVec
+	syncFailures           *counterVec
+	tunnelConnections      *counterVec
+	captures               *counterVec
+	tcpConnections         *counterVec
+	udpDatagrams           *counterVec
+	passthroughConnections *counterVec
+	edgeCache              *counterVec
+}
+
+var metrics = &gatewayMetrics{
+	requests:               newCounterVec("wormkey_http_requests_total", "Proxied viewer requests by response status.", "status"),
+	requestDuration:        newHistogramVec("wormkey_http_request_duration_seconds", "Proxied viewer request latency by response status.", latencyBuckets, "status"),
+	bytes:                  newCounterVec("wormkey_http_bytes_total", "Viewer body bytes; in = request bodies and TCP client data, out = response bodies and TCP data to clients.", "direction"),
+	frames:                 newCounterVec("wormkey_tunnel_frames_total", "Tunnel frames by type; in = from CLI, out = to CLI.", "type", "direction"),
+	policyRejections:       newCounterVec("wormkey_policy_rejections_total", "Viewer requests rejected at the edge by reason.", "reason"),
+	syncFailures:           newCounterVec("wormkey_control_plane_sync_failures_total", "Failed gateway -> control plane sync calls by operation.", "op"),
+	tunnelConnections:      newCounterVec("wormkey_tunnel_connections_total", "Tunnel WebSocket connections accepted."),
+	captures:               newCounterVec("wormkey_offline_captures_total", "Offline webhook capture events by result.", "result"),
+	tcpConnections:         newCounterVec("wormkey_tcp_connections_total", "Public TCP tunnel connections by result.", "result"),
+	passthroughConnections: newCounterVec("wormkey_tls_passthrough_connections_total", "TLS passthrough connections by result.", "result"),
+	udpDatagrams:           newCounterVec("wormkey_udp_datagrams_total", "UDP tunnel datagrams; in = from clients, out = to clients, dropped = no tunnel or rejected.", "direction"),
+	edgeCache:              newCounterVec("wormkey_edge_cache_requests_total", "Edge cache lookups by result (hit, revalidated, miss).", "result"),
+}
+
+func frameTypeName(t byte) string {
+	switch t {
+	case FrameOpenStream:
+		return "open_stream"
+	case FrameStreamData:
+		return "stream_data"
+	case FrameStreamEnd:
+		return "stream_end"
+	case FrameStreamCancel:
+		return "stream_cancel"
+	case FrameResponseHdrs:
+		return "response_headers"
+	case FrameWSUpgrade:
+		return "ws_upgrade"
+	case FrameWSData:
+		return "ws_data"
+	case FrameWSClose:
+		return "ws_close"
+	case FramePing:
+		return "ping"
+	case FramePong:
+		return "pong"
+	case FramePause:
+		return "pause"
+	case FrameResume:
+		return "resume"
+	case FrameTCPOpen:
+		return "tcp_open"
+	case FrameDatagram:
+		return "datagram"
+	case FrameResponseTrls:
+		return "response_trailers"
+	}
+	return "unknown"
+}
+
+// responseRecorder wraps the viewer ResponseWriter to capture status and body sizes
+// for metrics and access logs.
+type responseRecorder struct {
+	http.ResponseWriter
+	status     int
+	bytes      int64
+	bytesIn    atomic.Int64 // written by the request body pump goroutine
+	header     http.Header  // response headers as sent, for the inspector
+	body       *cappedBuffer
+	grpc       bool                 // gRPC request: gateway errors are written as gRPC statuses
+	acceptJSON bool                 // gateway errors are written as JSON
+	errorPages map[string]errorPage // the tunnel's branded gateway error pages
+}
+
+func (m *responseRecorder) WriteHeader(status int) {
+	if m.status == 0 {
+		m.status = status
+		m.header = m.ResponseWriter.Header().Clone()
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *responseRecorder) Write(p []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+		m.header = m.ResponseWriter.Header().Clone()
+	}
+	n, err := m.ResponseWriter.Write(p)
+	m.bytes += int64(n)
+	if m.body != nil {
+		m.body.Write(p[:n])
+	}
+	return n, err
+}
+
+func (m *responseRecorder) Flush() {
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (m *responseRecorder) Unwrap() http.ResponseWriter { return m.ResponseWriter }
+
+// trailers returns the trailers set on the response (http.TrailerPrefix keys), or nil.
+func (m *responseRecorder) trailers() http.Header {
+	var t http.Header
+	for k, v := range m.ResponseWriter.Header() {
+		if name, ok := strings.CutPrefix(k, http.TrailerPrefix); ok {
+			if t == nil {
+				t = http.Header{}
+			}
+			t[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	return t
+}
+
+func (m *responseRecorder) statusCode() int {
+	if m.status == 0 {
+		return http.StatusOK
+	}
+	return m.status
+}
+
+// observe records the finished request. Called once per proxied request.
+func (m *responseRecorder) observe(d time.Duration) {
+	code := strconv.Itoa(m.statusCode())
+	metrics.requests.Inc(code)
+	metrics.requestDuration.Observe(d.Seconds(), code)
+	metrics.bytes.Add(float64(m.bytes), "out")
+	metrics.bytes.Add(float64(m.bytesIn.Load()), "in")
+}
+
+func handleMetrics(tunnels *sync.Map) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		var slugs []string
+		streams := map[string]int32{}
+		streaming := map[string]int32{}
+		tunnels.Range(func(k, v any) bool {
+			slug := k.(string)
+			slugs = append(slugs, slug)
+			tc := v.(*tunnelConn)
+			streams[slug] = tc.activeStreams.Load()
+			streaming[slug] = tc.streamingStreams.Load()
+			return true
+		})
+		sort.Strings(slugs)
+		fmt.Fprintf(w, "# HELP wormkey_active_tunnels Connected tunnels.\n# TYPE wormkey_active_tunnels gauge\nwormkey_active_tunnels %d\n", len(slugs))
+		fmt.Fprintf(w, "# HELP wormkey_active_streams Open streams per tunnel, excluding streaming responses.\n# TYPE wormkey_active_streams gauge\n")
+		for _, slug := range slugs {
+			fmt.Fprintf(w, "wormkey_active_streams{slug=\"%s\"} %d\n", escapeLabelValue(slug), streams[slug])
+		}
+		fmt.Fprintf(w, "# HELP wormkey_streaming_streams Open streaming responses (SSE, NDJSON, ...) per tunnel.\n# TYPE wormkey_streaming_streams gauge\n")
+		for _, slug := range slugs {
+			fmt.Fprintf(w, "wormkey_streaming_streams{slug=\"%s\"} %d\n", escapeLabelValue(slug), streaming[slug])
+		}
+		metrics.tunnelConnections.writeTo(w)
+		metrics.requests.writeTo(w)
+		metrics.requestDuration.writeTo(w)
+		metrics.bytes.writeTo(w)
+		metrics.frames.writeTo(w)
+		metrics.policyRejections.writeTo(w)
+		metrics.syncFailures.writeTo(w)
+		metrics.captures.writeTo(w)
+		metrics.tcpConnections.writeTo(w)
+		metrics.udpDatagrams.writeTo(w)
+		metrics.passthroughConnections.writeTo(w)
+		metrics.edgeCache.writeTo(w)
+	}
+}
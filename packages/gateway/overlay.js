@@ -9,6 +9,8 @@
     var s = document.currentScript && document.currentScript.src;
     return s ? new URL(s).origin : window.location.origin;
   })();
+  // Set by the gateway when the page has a CSP; lets the <style> below pass a nonce-based style-src.
+  var cspNonce = (document.currentScript && document.currentScript.nonce) || '';
   function getSlug(){
     var s = new URLSearchParams(window.location.search).get('slug');
     if (s) return s;
@@ -64,7 +66,8 @@
     }
 
     var styleEl = document.createElement('style');
-    styleEl.textContent = '@keyframes tabbar-shield-spin{from{transform:rotate(0deg)}to{transform:rotate(360deg)}}#wormkey-overlay .tabbar-connected:hover .tabbar-shield{animation:tabbar-shield-spin .6s ease-in-out}#wormkey-overlay .tabbar-views .tabbar-eye{transform-origin:center;transition:transform .2s ease-out}#wormkey-overlay .tabbar-views:hover .tabbar-eye{transform:scaleY(.15)}#wormkey-overlay .tabbar-btn:hover{background:rgba(255,255,255,0.03)}#wormkey-overlay .tabbar-connected.tabbar-btn:hover,#wormkey-overlay .tabbar-views.tabbar-btn:hover{background:rgba(255,255,255,0.03)}#wormkey-overlay[data-theme="light"] #wormkey-panel{background:rgba(255,255,255,0.95);border:1px solid rgba(0,0,0,0.08)}#wormkey-overlay[data-theme="light"] .wormkey-bar{background:rgba(255,255,255,0.95);border:1px solid rgba(0,0,0,0.08);color:#1a1a1a}#wormkey-overlay[data-theme="light"] .wormkey-row{background:rgba(0,0,0,0.04)}#wormkey-overlay[data-theme="light"] .wormkey-row p span:first-child{color:rgba(0,0,0,0.8)!important}#wormkey-overlay[data-theme="light"] .wormkey-row p span:last-child{color:rgba(0,0,0,0.5)!important}#wormkey-overlay[data-theme="light"] .wormkey-copy-btn{background:rgba(0,0,0,0.12);color:#1a1a1a}#wormkey-overlay[data-theme="light"] .tabbar-btn{color:#1a1a1a}#wormkey-overlay[data-theme="light"] .tabbar-btn:hover{background:rgba(0,0,0,0.06)}#wormkey-overlay[data-theme="light"] .tabbar-btn.tabbar-active{background:rgba(0,0,0,0.12)!important}#wormkey-overlay[data-theme="light"] .wormkey-divider{background:rgba(0,0,0,0.15)!important}#wormkey-overlay[data-theme="light"] .wormkey-logs-list,#wormkey-overlay[data-theme="light"] .wormkey-views-list{color:rgba(0,0,0,0.6)!important}#wormkey-overlay[data-theme="light"] .wormkey-views-list .wormkey-view-row{background:rgba(0,0,0,0.04)!important;color:rgba(0,0,0,0.7)!important}#wormkey-overlay[data-theme="light"] .wormkey-views-empty{color:rgba(0,0,0,0.4)!important}@media(prefers-reduced-motion:reduce){#wormkey-overlay .tabbar-shield,#wormkey-overlay .tabbar-eye{animation:none!important;transition:none!important}}@media(max-width:480px){#wormkey-overlay{bottom:max(10px,env(safe-area-inset-bottom))!important;left:max(8px,env(safe-area-inset-left))!important;right:max(8px,env(safe-area-inset-right))!important;transform:none!important;width:auto!important;max-width:none!important}#wormkey-overlay #wormkey-panel{max-height:50vh;overflow-y:auto;-webkit-overflow-scrolling:touch}#wormkey-overlay .wormkey-bar{flex-wrap:wrap;height:auto;min-height:40px;padding:6px;gap:6px}#wormkey-overlay .wormkey-bar .tabbar-btn{padding:8px 10px;min-height:40px;font-size:11px;touch-action:manipulation}#wormkey-overlay .wormkey-bar>div:first-child{touch-action:none}#wormkey-overlay .wormkey-row p{font-size:11px;padding:8px}#wormkey-overlay .wormkey-row button{padding:8px 10px;font-size:11px;min-height:36px;touch-action:manipulation}#wormkey-overlay .wormkey-row .wormkey-copy-btn{min-width:36px;min-height:36px}}';
+    if (cspNonce) styleEl.nonce = cspNonce;
+    styleEl.textContent = '@keyframes tabbar-shield-spin{from{transform:rotate(0deg)}to{transform:rotate(360deg)}}#wormkey-overlay .tabbar-connected:hover .tabbar-shield{animation:tabbar-shield-spin .6s ease-in-out}#wormkey-overlay .tabbar-views .tabbar-eye{transform-origin:center;transition:transform .2s ease-out}#wormkey-overlay .tabbar-views:hover .tabbar-eye{transform:scaleY(.15)}#wormkey-overlay .tabbar-btn:hover{background:rgba(255,255,255,0.03)}#wormkey-overlay .tabbar-connected.tabbar-btn:hover,#wormkey-overlay .tabbar-views.tabbar-btn:hover{background:rgba(255,255,255,0.03)}#wormkey-overlay[data-theme="light"] #wormkey-panel{background:rgba(255,255,255,0.95);border:1px solid rgba(0,0,0,0.08)}#wormkey-overlay[data-theme="light"] .wormkey-bar{background:rgba(255,255,255,0.95);border:1px solid rgba(0,0,0,0.08);color:#1a1a1a}#wormkey-overlay[data-theme="light"] .wormkey-row{background:rgba(0,0,0,0.04)}#wormkey-overlay[data-theme="light"] .wormkey-row p span:first-child{color:rgba(0,0,0,0.8)!important}#wormkey-overlay[data-theme="light"] .wormkey-row p span:last-child{color:rgba(0,0,0,0.5)!important}#wormkey-overlay[data-theme="light"] .wormkey-copy-btn{background:rgba(0,0,0,0.12);color:#1a1a1a}#wormkey-overlay[data-theme="light"] .tabbar-btn{color:#1a1a1a}#wormkey-overlay[data-theme="light"] .tabbar-btn:hover{background:rgba(0,0,0,0.06)}#wormkey-overlay[data-theme="light"] .tabbar-btn.tabbar-active{background:rgba(0,0,0,0.12)!important}#wormkey-overlay[data-theme="light"] .wormkey-divider{background:rgba(0,0,0,0.15)!important}#wormkey-overlay[data-theme="light"] .wormkey-logs-list,#wormkey-overlay[data-theme="light"] .wormkey-views-list,#wormkey-overlay[data-theme="light"] .wormkey-requests-list{color:rgba(0,0,0,0.6)!important}#wormkey-overlay[data-theme="light"] .wormkey-views-list .wormkey-view-row{background:rgba(0,0,0,0.04)!important;color:rgba(0,0,0,0.7)!important}#wormkey-overlay[data-theme="light"] .wormkey-views-empty,#wormkey-overlay[data-theme="light"] .wormkey-requests-empty{color:rgba(0,0,0,0.4)!important}#wormkey-overlay[data-theme="light"] .wormkey-request-row{background:rgba(0,0,0,0.04)!important}@media(prefers-reduced-motion:reduce){#wormkey-overlay .tabbar-shield,#wormkey-overlay .tabbar-eye{animation:none!important;transition:none!important}}@media(max-width:480px){#wormkey-overlay{bottom:max(10px,env(safe-area-inset-bottom))!important;left:max(8px,env(safe-area-inset-left))!important;right:max(8px,env(safe-area-inset-right))!important;transform:none!important;width:auto!important;max-width:none!important}#wormkey-overlay #wormkey-panel{max-height:50vh;overflow-y:auto;-webkit-overflow-scrolling:touch}#wormkey-overlay .wormkey-bar{flex-wrap:wrap;height:auto;min-height:40px;padding:6px;gap:6px}#wormkey-overlay .wormkey-bar .tabbar-btn{padding:8px 10px;min-height:40px;font-size:11px;touch-action:manipulation}#wormkey-overlay .wormkey-bar>div:first-child{touch-action:none}#wormkey-overlay .wormkey-row p{font-size:11px;padding:8px}#wormkey-overlay .wormkey-row button{padding:8px 10px;font-size:11px;min-height:36px;touch-action:manipulation}#wormkey-overlay .wormkey-row .wormkey-copy-btn{min-width:36px;min-height:36px}}';
     document.head.appendChild(styleEl);
 
     var root = document.createElement('div');
@@ -155,6 +158,107 @@
     viewsList.style.cssText = 'font:10px "Geist",sans-serif;color:rgba(255,255,255,0.6);max-height:120px;overflow-y:auto';
     viewsContent.appendChild(viewsList);
 
+    var requestsContent = document.createElement('div');
+    requestsContent.style.cssText = 'display:flex;flex-direction:column;gap:4px;padding:4px';
+    var requestsList = document.createElement('div');
+    requestsList.className = 'wormkey-requests-list';
+    requestsList.style.cssText = 'font:10px ui-monospace,SFMono-Regular,Menlo,monospace;color:rgba(255,255,255,0.6);max-height:240px;overflow-y:auto';
+    requestsContent.appendChild(requestsList);
+    var requestIds = {};
+    var requestsLoaded = false;
+    var requestsFeed = null;
+    var MAX_REQUEST_ROWS = 100;
+
+    function fmtHeaders(h){
+      if (!h) return '';
+      return Object.keys(h).map(function(k){ return k + ': ' + [].concat(h[k]).join(', '); }).join('\n');
+    }
+    function fmtBody(b){
+      if (!b || !b.size) return '(empty)';
+      var s = b.encoding === 'base64' ? '[base64] ' + b.data : b.data;
+      return b.truncated ? s + '\n… truncated' : s;
+    }
+    function addRequestRow(rq){
+      if (!rq || requestIds[rq.id]) return;
+      requestIds[rq.id] = true;
+      var empty = requestsList.querySelector('.wormkey-requests-empty');
+      if (empty) requestsList.removeChild(empty);
+      var item = document.createElement('div');
+      item.className = 'wormkey-request-row';
+      item.style.cssText = 'padding:6px 10px;border-radius:6px;background:rgba(255,255,255,0.02);margin-bottom:2px';
+      var summary = document.createElement('div');
+      summary.style.cssText = 'display:flex;gap:8px;white-space:nowrap;overflow:hidden;text-overflow:ellipsis;cursor:pointer';
+      var statusColor = rq.status >= 500 ? '#FF6B6B' : rq.status >= 400 ? '#FFB86B' : '#5BFF6D';
+      summary.innerHTML = '<span style="color:' + statusColor + '">' + rq.status + '</span><span style="color:rgba(255,255,255,0.8)"></span><span style="flex:1;min-width:0;overflow:hidden;text-overflow:ellipsis"></span><span></span>';
+      summary.children[1].textContent = rq.method;
+      summary.children[2].textContent = (rq.replayOf ? '↻ ' : '') + rq.path + (rq.rejection ? ' (' + rq.rejection + ')' : '');
+      summary.children[3].textContent = Math.round(rq.durationMs) + 'ms';
+      var detail = document.createElement('div');
+      detail.style.cssText = 'display:none;margin:6px 0 0';
+      var detailText = document.createElement('pre');
+      detailText.style.cssText = 'margin:0;white-space:pre-wrap;word-break:break-all;color:rgba(255,255,255,0.6);font:inherit';
+      detailText.textContent = new Date(rq.startedAt).toLocaleTimeString() + (rq.viewerId ? ' · viewer ' + rq.viewerId : rq.owner ? ' · owner' : '') +
+        '\n\n— Request headers —\n' + fmtHeaders(rq.requestHeaders) +
+        '\n\n— Request body —\n' + fmtBody(rq.requestBody) +
+        '\n\n— Response headers —\n' + fmtHeaders(rq.responseHeaders) +
+        '\n\n— Response body —\n' + fmtBody(rq.responseBody);
+      detail.appendChild(detailText);
+      var replayBody = document.createElement('textarea');
+      replayBody.placeholder = 'Request body (edit before replaying)';
+      replayBody.value = rq.requestBody && rq.requestBody.encoding !== 'base64' ? rq.requestBody.data || '' : '';
+      replayBody.style.cssText = 'display:block;width:100%;box-sizing:border-box;margin:6px 0 4px;min-height:48px;border:0;border-radius:6px;padding:6px;background:rgba(255,255,255,0.06);color:inherit;font:inherit;resize:vertical';
+      var replayBtn = document.createElement('button');
+      replayBtn.className = 'wormkey-copy-btn';
+      replayBtn.textContent = 'Replay';
+      replayBtn.style.cssText = 'border:0;border-radius:6px;padding:4px 10px;cursor:pointer;background:rgba(255,255,255,0.15);color:#fff;font:10px "Geist",sans-serif;font-weight:500';
+      var replayResult = document.createElement('span');
+      replayResult.style.cssText = 'margin-left:8px';
+      replayBtn.onclick = function(){
+        var edit = {};
+        var original = rq.requestBody && rq.requestBody.encoding !== 'base64' ? rq.requestBody.data || '' : null;
+        if (original === null ? replayBody.value !== '' : replayBody.value !== original) edit.body = replayBody.value;
+        replayBtn.disabled = true;
+        replayResult.textContent = 'Replaying…';
+        var replayUrl = new URL(buildUrl('/.wormkey/replay'));
+        replayUrl.searchParams.set('id', rq.id);
+        fetch(replayUrl.toString(), { method:'POST', credentials:'include', headers:{'Content-Type':'application/json'}, body: JSON.stringify(edit) })
+          .then(function(r){ if (!r.ok) return r.text().then(function(t){ throw new Error(t || String(r.status)); }); return r.json(); })
+          .then(function(res){ replayResult.textContent = 'Replayed → ' + res.replay.status + ' (original ' + res.original.status + ', ' + Math.round(res.replay.durationMs) + 'ms)'; addRequestRow(res.replay); })
+          .catch(function(e){ replayResult.textContent = 'Replay failed: ' + e.message; })
+          .then(function(){ replayBtn.disabled = false; });
+      };
+      if (!rq.rejection) {
+        detail.appendChild(replayBody);
+        detail.appendChild(replayBtn);
+        detail.appendChild(replayResult);
+      }
+      summary.onclick = function(){ detail.style.display = detail.style.display === 'none' ? 'block' : 'none'; };
+      item.appendChild(summary);
+      item.appendChild(detail);
+      requestsList.insertBefore(item, requestsList.firstChild);
+      while (requestsList.children.length > MAX_REQUEST_ROWS) requestsList.removeChild(requestsList.lastChild);
+    }
+    function loadRequests(){
+      if (requestsLoaded) return;
+      requestsLoaded = true;
+      req('/.wormkey/requests').then(function(r){ if (!r.ok) throw new Error('requests'); return r.json(); }).then(function(d){
+        (d.requests || []).forEach(addRequestRow);
+        if (!requestsList.children.length) {
+          var empty = document.createElement('div');
+          empty.className = 'wormkey-requests-empty';
+          empty.style.cssText = 'padding:10px;color:rgba(255,255,255,0.4)';
+          empty.textContent = 'No requests yet';
+          requestsList.appendChild(empty);
+        }
+      }).catch(function(){ requestsLoaded = false; });
+      if (!requestsFeed && window.EventSource) {
+        requestsFeed = new EventSource(buildUrl('/.wormkey/requests/live'), { withCredentials: true });
+        requestsFeed.addEventListener('request', function(ev){
+          try { addRequestRow(JSON.parse(ev.data)); } catch(e){}
+        });
+      }
+    }
+
     var logEntries = [];
     var connectedAt = null;
     var prevViewerCount = 0;
@@ -187,6 +291,13 @@
     logsTabBtn.onclick = function(){ activeTab = 'logs'; panelOpen = true; panel.style.display = 'flex'; setTab(); };
     bar.appendChild(logsTabBtn);
 
+    var requestsTabBtn = document.createElement('button');
+    requestsTabBtn.className = 'tabbar-btn';
+    requestsTabBtn.textContent = 'Requests';
+    requestsTabBtn.style.cssText = 'border:0;background:transparent;border-radius:6px;padding:0 10px;cursor:pointer;color:#fff;font:10px "Geist",sans-serif;font-weight:500;opacity:0.5;white-space:nowrap;display:flex;align-items:center;justify-content:center;transition:background .15s';
+    requestsTabBtn.onclick = function(){ activeTab = 'requests'; panelOpen = true; panel.style.display = 'flex'; setTab(); loadRequests(); };
+    bar.appendChild(requestsTabBtn);
+
     var viewsTabBtn = document.createElement('button');
     viewsTabBtn.className = 'tabbar-btn';
     viewsTabBtn.textContent = 'Views';
@@ -194,6 +305,13 @@
     viewsTabBtn.onclick = function(){ activeTab = 'views'; panelOpen = true; panel.style.display = 'flex'; setTab(); };
     bar.appendChild(viewsTabBtn);
 
+    var purgeBtn = document.createElement('button');
+    purgeBtn.className = 'tabbar-btn';
+    purgeBtn.textContent = 'Purge Cache';
+    purgeBtn.title = 'Drop everything the edge has cached for this tunnel';
+    purgeBtn.style.cssText = 'border:0;background:transparent;border-radius:6px;padding:0 10px;cursor:pointer;color:#fff;font:10px "Geist",sans-serif;font-weight:500;opacity:0.5;white-space:nowrap;display:none;align-items:center;justify-content:center;transition:background .15s';
+    bar.appendChild(purgeBtn);
+
     var closeBtn = document.createElement('button');
     closeBtn.className = 'tabbar-btn';
     closeBtn.textContent = 'Close Tunnel';
@@ -234,6 +352,7 @@
     function setMobileLabels(){
       var mobile = mq.matches;
       copyTabBtn.textContent = mobile ? 'Copy' : 'Copy Url';
+      purgeBtn.textContent = mobile ? 'Purge' : 'Purge Cache';
       closeBtn.textContent = mobile ? 'Close' : 'Close Tunnel';
     }
     mq.addEventListener('change', setMobileLabels);
@@ -243,14 +362,18 @@
       copyContent.style.display = activeTab === 'copy' ? 'flex' : 'none';
       logsContent.style.display = activeTab === 'logs' ? 'flex' : 'none';
       viewsContent.style.display = activeTab === 'views' ? 'flex' : 'none';
+      requestsContent.style.display = activeTab === 'requests' ? 'flex' : 'none';
       var isActive = panelOpen;
-      [copyTabBtn,logsTabBtn,viewsTabBtn].forEach(function(btn){ btn.classList.remove('tabbar-active'); });
+      [copyTabBtn,logsTabBtn,requestsTabBtn,viewsTabBtn].forEach(function(btn){ btn.classList.remove('tabbar-active'); });
       copyTabBtn.style.background = isActive && activeTab === 'copy' ? 'rgba(255,255,255,0.15)' : 'transparent';
       copyTabBtn.style.opacity = isActive && activeTab === 'copy' ? '1' : '0.5';
       if (isActive && activeTab === 'copy') copyTabBtn.classList.add('tabbar-active');
       logsTabBtn.style.background = isActive && activeTab === 'logs' ? 'rgba(255,255,255,0.15)' : 'transparent';
       logsTabBtn.style.opacity = isActive && activeTab === 'logs' ? '1' : '0.5';
       if (isActive && activeTab === 'logs') logsTabBtn.classList.add('tabbar-active');
+      requestsTabBtn.style.background = isActive && activeTab === 'requests' ? 'rgba(255,255,255,0.15)' : 'transparent';
+      requestsTabBtn.style.opacity = isActive && activeTab === 'requests' ? '1' : '0.5';
+      if (isActive && activeTab === 'requests') requestsTabBtn.classList.add('tabbar-active');
       viewsTabBtn.style.background = isActive && activeTab === 'views' ? 'rgba(255,255,255,0.15)' : 'transparent';
       viewsTabBtn.style.opacity = isActive && activeTab === 'views' ? '1' : '0.5';
       if (isActive && activeTab === 'views') viewsTabBtn.classList.add('tabbar-active');
@@ -260,6 +383,8 @@
       if (tunnelClosed) return;
       req('/.wormkey/state').then(function(r){ if (!r.ok) throw new Error('state'); return r.json(); }).then(function(s){
         var count = s.activeViewers || 0;
+        purgeBtn.style.display = s.cache ? 'flex' : 'none';
+        if (s.cache) purgeBtn.title = 'Drop ' + s.cache.entries + ' cached responses (' + s.cache.hits + ' hits so far)';
         viewerCount.textContent = String(count);
         if (connectedAt === null) {
           connectedAt = new Date();
@@ -300,6 +425,12 @@
       }).catch(function(){});
     }
 
+    purgeBtn.onclick = function(){
+      req('/.wormkey/purge', { method:'POST' }).then(function(r){ if (!r.ok) throw new Error('purge'); return r.json(); }).then(function(res){
+        addLog('Edge cache purged (' + res.purged + ' responses)');
+      }).catch(function(){ addLog('Cache purge failed'); });
+    };
+
     closeBtn.onclick = function(){
       if (tunnelClosed) {
         window.location.reload();
@@ -313,12 +444,14 @@
         statusText.style.color = '#818181';
         statusWrap.querySelectorAll('svg path').forEach(function(p){ p.setAttribute('fill', '#818181'); });
         addLog('Tunnel closed at ' + new Date().toLocaleTimeString());
+        if (requestsFeed) { requestsFeed.close(); requestsFeed = null; }
       });
     };
 
     panel.appendChild(copyContent);
     panel.appendChild(logsContent);
     panel.appendChild(viewsContent);
+    panel.appendChild(requestsContent);
     root.appendChild(panel);
     root.appendChild(bar);
 
@@ -0,0 +1,154 @@
+// TLS passthrough: tunnels opened with X-Wormkey-Tunnel-Mode: tls receive the raw TLS
+// connection for their hostname. The gateway only reads the ClientHello SNI to pick the
+// slug; the handshake and everything after it is end-to-end with the local service.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const clientHelloTimeout = 5 * time.Second
+
+// passthroughAddr is the listen address for TLS passthrough ("" disables it). When it
+// equals WORMKEY_TLS_ADDR, names that are not passthrough tunnels fall through to the
+// gateway's own TLS server on the same port.
+var passthroughAddr string
+
+// sniListener routes accepted connections by SNI. Connections for passthrough tunnels are
+// forwarded raw; the rest are handed to Accept callers (the TLS server) with the peeked
+// ClientHello replayed, or closed when there is no fallback.
+type sniListener struct {
+	net.Listener
+	tunnels  *sync.Map
+	fallback bool
+	conns    chan net.Conn
+	done     chan struct{}
+	err      error
+}
+
+func newSNIListener(ln net.Listener, tunnels *sync.Map, fallback bool) *sniListener {
+	l := &sniListener{Listener: ln, tunnels: tunnels, fallback: fallback, conns: make(chan net.Conn), done: make(chan struct{})}
+	go l.serve()
+	return l
+}
+
+func (l *sniListener) serve() {
+	defer close(l.done)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			return
+		}
+		go l.route(conn)
+	}
+}
+
+func (l *sniListener) route(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	hello, peeked, err := peekClientHello(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	pc := &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(peeked), conn)}
+	if err == nil && hello.ServerName != "" {
+		if slug := extractSlugFromHost(hello.ServerName); slug != "" {
+			if val, ok := l.tunnels.Load(slug); ok && val.(*tunnelConn).mode == "tls" {
+				handleTCPConn(l.tunnels, slug, pc, "tls")
+				return
+			}
+		}
+	}
+	if !l.fallback {
+		metrics.passthroughConnections.Inc("no_route")
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- pc:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept returns connections that are not passthrough, for the gateway's TLS server.
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// prefixConn replays bytes read while peeking before continuing with the connection.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// peekClientHello parses the ClientHello from r and returns it with the bytes consumed.
+// It runs a server handshake over a read-only conn and aborts once the hello is parsed.
+func peekClientHello(r io.Reader) (*tls.ClientHelloInfo, []byte, error) {
+	var peeked bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{r: io.TeeReader(r, &peeked)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *h
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, peeked.Bytes(), err
+	}
+	return hello, peeked.Bytes(), nil
+}
+
+// readOnlyConn lets crypto/tls read a ClientHello without writing anything back.
+type readOnlyConn struct{ r io.Reader }
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// servePassthrough runs a passthrough-only listener (no fallback TLS server).
+func servePassthrough(tunnels *sync.Map) {
+	ln, err := net.Listen("tcp", passthroughAddr)
+	if err != nil {
+		log.Fatalf("passthrough: %v", err)
+	}
+	log.Println("listening (TLS passthrough) on", passthroughAddr)
+	<-newSNIListener(ln, tunnels, false).done
+}
+
+// passthroughPublicAddr is the host:port viewers use to reach a passthrough slug.
+func passthroughPublicAddr(slug string) string {
+	_, port, err := net.SplitHostPort(passthroughAddr)
+	if err != nil || port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(slug+"."+baseDomains[0], port)
+}
@@ -0,0 +1,193 @@
+// Public port pools for raw (TCP and UDP) tunnels. A slug keeps its port across
+// reconnects; the port is released a while after the last tunnel for it goes away.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tunnelModeHeader = "X-Wormkey-Tunnel-Mode"
+	portReleaseAfter = time.Minute // keep a port through reconnects before releasing it
+)
+
+// publicAddrHeaders name the upgrade response header carrying the public host:port.
+var publicAddrHeaders = map[string]string{"tcp": "X-Wormkey-Tcp-Addr", "udp": "X-Wormkey-Udp-Addr", "tls": "X-Wormkey-Tls-Addr"}
+
+// portEndpoint is a public listener bound to a slug. It outlives individual tunnel
+// connections so a reconnecting CLI keeps its port.
+type portEndpoint struct {
+	slug    string
+	port    int
+	ln      io.Closer // net.Listener or net.PacketConn
+	release *time.Timer
+}
+
+type portPool struct {
+	network   string // "tcp" or "udp"
+	mu        sync.Mutex
+	first     int
+	last      int
+	host      string
+	serve     func(tunnels *sync.Map, slug string, ln io.Closer)
+	endpoints map[string]*portEndpoint // slug -> endpoint
+	used      map[int]bool
+}
+
+// tcpPorts and udpPorts are nil unless WORMKEY_TCP_PORTS / WORMKEY_UDP_PORTS is set.
+var tcpPorts, udpPorts *portPool
+
+var errNoPorts = errors.New("no ports available")
+
+// newPortPool parses a range like "20000-20099"; nil disables the tunnel mode.
+func newPortPool(network, portRange, host string, serve func(*sync.Map, string, io.Closer)) *portPool {
+	lo, hi, ok := strings.Cut(portRange, "-")
+	first, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	last, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if !ok || err1 != nil || err2 != nil || first <= 0 || last < first || last > 65535 {
+		if portRange != "" {
+			log.Printf("%s: invalid port range %q; %s tunnels disabled", network, portRange, strings.ToUpper(network))
+		}
+		return nil
+	}
+	return &portPool{network: network, first: first, last: last, host: host, serve: serve, endpoints: map[string]*portEndpoint{}, used: map[int]bool{}}
+}
+
+func (p *portPool) listen(port int) (io.Closer, error) {
+	addr := ":" + strconv.Itoa(port)
+	if p.network == "udp" {
+		return net.ListenPacket("udp", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// bind returns the slug's endpoint, listening on a free port from the pool if it has none.
+func (p *portPool) bind(tunnels *sync.Map, slug string) (*portEndpoint, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ep, ok := p.endpoints[slug]; ok {
+		if ep.release != nil {
+			ep.release.Stop()
+			ep.release = nil
+		}
+		return ep, nil
+	}
+	for port := p.first; port <= p.last; port++ {
+		if p.used[port] {
+			continue
+		}
+		ln, err := p.listen(port)
+		if err != nil {
+			continue // taken by something else
+		}
+		ep := &portEndpoint{slug: slug, port: port, ln: ln}
+		p.endpoints[slug] = ep
+		p.used[port] = true
+		go p.serve(tunnels, slug, ln)
+		log.Printf("%s: %s listening on :%d", p.network, slug, port)
+		return ep, nil
+	}
+	return nil, errNoPorts
+}
+
+// releaseLater frees the slug's port unless a tunnel for it reconnects in time.
+func (p *portPool) releaseLater(tunnels *sync.Map, slug string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ep, ok := p.endpoints[slug]
+	if !ok {
+		return
+	}
+	if ep.release != nil {
+		ep.release.Stop()
+	}
+	ep.release = time.AfterFunc(portReleaseAfter, func() {
+		if _, connected := tunnels.Load(slug); !connected {
+			p.releaseNow(slug)
+		}
+	})
+}
+
+func (p *portPool) releaseNow(slug string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ep, ok := p.endpoints[slug]; ok {
+		ep.ln.Close()
+		delete(p.endpoints, slug)
+		delete(p.used, ep.port)
+		log.Printf("%s: released :%d (%s)", p.network, ep.port, slug)
+	}
+}
+
+func (p *portPool) publicAddr(ep *portEndpoint) string {
+	return net.JoinHostPort(p.host, strconv.Itoa(ep.port))
+}
+
+// addrFor returns the slug's public address, or "" if it has no port.
+func (p *portPool) addrFor(slug string) string {
+	if p == nil {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ep, ok := p.endpoints[slug]; ok {
+		return p.publicAddr(ep)
+	}
+	return ""
+}
+
+// portPoolFor returns the pool serving a raw tunnel mode, or nil for HTTP tunnels.
+func portPoolFor(mode string) *portPool {
+	switch mode {
+	case "tcp":
+		return tcpPorts
+	case "udp":
+		return udpPorts
+	}
+	return nil
+}
+
+// rawViewerID identifies TCP and UDP clients by IP so owners can kick them.
+func rawViewerID(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return "ip:" + host
+}
+
+// admitRaw applies the viewer policy to a new TCP connection or UDP flow and returns
+// the rejection reason, or "" after registering the viewer.
+func (tc *tunnelConn) admitRaw(viewerID, remoteAddr string) string {
+	tc.policyMu.RLock()
+	policy := tc.policy
+	tc.policyMu.RUnlock()
+	tc.viewerMu.RLock()
+	_, kicked := tc.kickedViewers[viewerID]
+	_, known := tc.viewers[viewerID]
+	viewerCount := len(tc.viewers)
+	tc.viewerMu.RUnlock()
+	switch {
+	case kicked:
+		return "kicked"
+	case !policy.Public:
+		return "locked"
+	case tc.paused.Load():
+		return "paused"
+	case !known && policy.MaxConcurrentViewers > 0 && viewerCount >= policy.MaxConcurrentViewers:
+		return "too_many_viewers"
+	}
+	tc.upsertViewer(viewerID, remoteAddr)
+	return ""
+}
@@ -0,0 +1,181 @@
+// Owner replay of requests recorded by the inspector.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// replayRequest optionally edits the recorded request before it is resent.
+// Headers with an empty value are removed.
+type replayRequest struct {
+	Method       *string           `json:"method"`
+	Path         *string           `json:"path"`
+	Headers      map[string]string `json:"headers"`
+	Body         *string           `json:"body"`
+	BodyEncoding string            `json:"bodyEncoding"` // "base64" or empty for text
+}
+
+// bufferedResponse collects a response the gateway itself requested (replays and
+// delivered captures) instead of streaming it to a viewer.
+type bufferedResponse struct {
+	mu     sync.Mutex
+	header http.Header
+	status int
+	body   *cappedBuffer
+}
+
+func (br *bufferedResponse) Header() http.Header { return br.header }
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.status == 0 {
+		br.status = status
+	}
+}
+
+func (br *bufferedResponse) Write(p []byte) (int, error) {
+	br.mu.Lock()
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	br.mu.Unlock()
+	return br.body.Write(p)
+}
+
+func (br *bufferedResponse) Flush() {}
+
+// forwardBuffered sends req with body through the tunnel like handleProxy does and
+// returns an inspector record of the exchange (not yet recorded).
+func (tc *tunnelConn) forwardBuffered(ctx context.Context, req *http.Request, body []byte) (*inspectedRequest, error) {
+	start := time.Now()
+	req.ContentLength = int64(len(body))
+	resp := &bufferedResponse{header: http.Header{}, body: newCappedBuffer(inspectorBodyLimit)}
+	reqBody := newCappedBuffer(inspectorBodyLimit)
+	reqBody.Write(body)
+	streamID, err := tc.forwardStream(ctx, resp, req, streamOptions{})
+	if err != nil {
+		return nil, err
+	}
+	status := resp.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return &inspectedRequest{
+		ID:              req.Header.Get(requestIDHeader),
+		StreamID:        streamID,
+		Method:          req.Method,
+		Path:            req.URL.RequestURI(),
+		RequestHeaders:  redactGatewayCookies(req.Header),
+		RequestBody:     newInspectedBody(reqBody),
+		Status:          status,
+		ResponseHeaders: resp.header,
+		ResponseBody:    newInspectedBody(resp.body),
+		StartedAt:       start.UTC().Format(time.RFC3339Nano),
+		DurationMs:      float64(time.Since(start).Microseconds()) / 1000,
+	}, nil
+}
+
+func handleReplay(tunnels *sync.Map) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		slug := resolveSlug(r)
+		val, ok := tunnels.Load(slug)
+		if !ok {
+			http.Error(w, "Tunnel not connected", 503)
+			return
+		}
+		tc := val.(*tunnelConn)
+		if !isOwner(r, tc) {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		id := r.URL.Query().Get("id")
+		orig := tc.inspector.find(id)
+		if orig == nil {
+			http.Error(w, "Unknown request id", 404)
+			return
+		}
+		var edit replayRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&edit); err != nil && err != io.EOF {
+				http.Error(w, "Invalid JSON", 400)
+				return
+			}
+		}
+		method, path := orig.Method, orig.Path
+		if edit.Method != nil && *edit.Method != "" {
+			method = *edit.Method
+		}
+		if edit.Path != nil && *edit.Path != "" {
+			path = *edit.Path
+		}
+		var body []byte
+		if edit.Body != nil {
+			if edit.BodyEncoding == "base64" {
+				b, err := base64.StdEncoding.DecodeString(*edit.Body)
+				if err != nil {
+					http.Error(w, "Invalid base64 body", 400)
+					return
+				}
+				body = b
+			} else {
+				body = []byte(*edit.Body)
+			}
+		} else {
+			if orig.RequestBody.Truncated {
+				http.Error(w, "Recorded body was truncated; send an edited body to replay", 409)
+				return
+			}
+			body = orig.RequestBody.decode()
+		}
+		u, err := url.ParseRequestURI(path)
+		if err != nil {
+			http.Error(w, "Invalid path", 400)
+			return
+		}
+		out, err := http.NewRequestWithContext(r.Context(), method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, "Invalid request", 400)
+			return
+		}
+		out.Header = orig.RequestHeaders.Clone()
+		for k, v := range edit.Headers {
+			if v == "" {
+				out.Header.Del(k)
+			} else {
+				out.Header.Set(k, v)
+			}
+		}
+		out.Header.Del("Traceparent")
+		out.Header.Del("Tracestate")
+		if len(body) > 0 || out.Header.Get("Content-Length") != "" {
+			out.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		out.Header.Set(requestIDHeader, newRequestID())
+		out.Header.Set("X-Wormkey-Replay-Of", orig.ID)
+		replayed, err := tc.forwardBuffered(r.Context(), out, body)
+		if err != nil {
+			http.Error(w, "Tunnel connection lost", 502)
+			return
+		}
+		replayed.Owner = true
+		replayed.ReplayOf = orig.ID
+		tc.inspector.record(replayed)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"original": orig, "replay": replayed})
+	}
+}
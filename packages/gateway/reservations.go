@@ -0,0 +1,73 @@
+// Reserved slugs: a slug reserved by an account can only be bound by a tunnel whose
+// control plane session belongs to that account, and stays reserved across sessions.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type slugReservation struct {
+	Slug      string `json:"slug"`
+	AccountID string `json:"accountId"`
+}
+
+// reservedSlugs caches slug -> accountID from successful lookups, so a control plane
+// outage cannot open a reserved slug to other tunnels.
+var reservedSlugs sync.Map
+
+func fetchReservation(controlPlaneURL, slug string) (slugReservation, bool, error) {
+	if controlPlaneURL == "" {
+		return slugReservation{}, false, fmt.Errorf("control plane url is empty")
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(controlPlaneURL, "/")+"/reservations/by-slug/"+slug, nil)
+	if err != nil {
+		return slugReservation{}, false, err
+	}
+	signControlPlaneRequest(req, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return slugReservation{}, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var res slugReservation
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return slugReservation{}, false, err
+		}
+		reservedSlugs.Store(slug, res.AccountID)
+		return res, true, nil
+	case http.StatusNotFound:
+		reservedSlugs.Delete(slug)
+		return slugReservation{}, false, nil
+	}
+	return slugReservation{}, false, fmt.Errorf("reservation lookup: status %d", resp.StatusCode)
+}
+
+// authorizeReservedSlug checks whether a tunnel presenting ownerToken may bind slug.
+// A non-zero status means reject with that status and message.
+func authorizeReservedSlug(controlPlaneURL, slug, ownerToken string) (reserved bool, status int, msg string) {
+	res, reserved, err := fetchReservation(controlPlaneURL, slug)
+	if err != nil {
+		if _, cached := reservedSlugs.Load(slug); cached {
+			return true, http.StatusServiceUnavailable, "Control plane unavailable"
+		}
+		return false, 0, ""
+	}
+	if !reserved {
+		return false, 0, ""
+	}
+	sess, sessStatus, err := fetchSession(controlPlaneURL, slug)
+	if err != nil || (sessStatus != http.StatusOK && sessStatus != http.StatusNotFound) {
+		return true, http.StatusServiceUnavailable, "Control plane unavailable"
+	}
+	if sessStatus != http.StatusOK || sess.Closed || sess.AccountID != res.AccountID || ownerToken == "" || sess.OwnerToken != ownerToken {
+		return true, http.StatusForbidden, "Slug is reserved"
+	}
+	return true, 0, ""
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Vectors: slack and github from the providers' documentation, generic hmac from
+// RFC 4231 / RFC 2202 test case 2, stripe computed with openssl.
+const (
+	slackSecret = "8f742231b10e8888abcd99yyyzzz85a5"
+	slackBody   = "token=xyzz0WbapA4vBCDEFasx0q6G&team_id=T1DC2JH3J&team_domain=testteamnow&channel_id=G8PSS9T3V&channel_name=foobar&user_id=U2CERLKJA&user_name=roadrunner&command=%2Fwebhook-collect&text=&response_url=https%3A%2F%2Fhooks.slack.com%2Fcommands%2FT1DC2JH3J%2F397700885554%2F96rGlfmibIGlgcZRskXaIFfN&trigger_id=398738663015.47445629121.803a0bc887a14d10d2c447fce8b6703c"
+	slackSig    = "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503"
+	slackTS     = "1531420618"
+
+	githubSecret = "It's a Secret to Everybody"
+	githubBody   = "Hello, World!"
+	githubSig    = "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"
+
+	stripeSecret = "whsec_test"
+	stripeBody   = `{"id":"evt_1","type":"charge.succeeded"}`
+	stripeSig    = "a3f7d2647ca8af4e7ebbd79c4f9380dbd98ee11b35cf0485b700ca327380e947"
+	stripeTS     = "1700000000"
+
+	hmacBody      = "what do ya want for nothing?"
+	hmacSHA256    = "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	hmacSHA256B64 = "W9zBRr9gdU5qBCQmCJV1x1oAPwidJzmDnexYuWTsOEM="
+	hmacSHA1      = "effcdf6ae5eb2fa2d27416d5f184df9c259a7c79"
+	hmacSHA512    = "164b7a7bfcf819e2e395fbe73b56e0a387bd64222e831fd610270cd7ea2505549758bf75c05a994a6d034f65f8f0e6fdcaeab1a34d4a6b4b636e070a38bce737"
+	hmacTimed     = "1cdd0650c8be1cb0974b1788d458b1e781206cfef59b85faafc582d2e182c57e" // over "1700000000.<body>"
+)
+
+func TestSignatureVerify(t *testing.T) {
+	at := func(ts string) time.Time {
+		sec, _ := strconv.ParseInt(ts, 10, 64)
+		return time.Unix(sec, 0)
+	}
+	tests := []struct {
+		name   string
+		rule   signatureRule
+		header map[string]string
+		body   string
+		now    time.Time
+		ok     bool
+	}{
+		{
+			name:   "stripe",
+			rule:   signatureRule{Scheme: "stripe", Secret: stripeSecret},
+			header: map[string]string{"Stripe-Signature": "t=" + stripeTS + ",v1=" + stripeSig},
+			body:   stripeBody, now: at(stripeTS), ok: true,
+		},
+		{
+			name:   "stripe any v1 matches",
+			rule:   signatureRule{Scheme: "stripe", Secret: stripeSecret},
+			header: map[string]string{"Stripe-Signature": "t=" + stripeTS + ",v1=00,v1=" + stripeSig + ",v0=ff"},
+			body:   stripeBody, now: at(stripeTS), ok: true,
+		},
+		{
+			name:   "stripe bad signature",
+			rule:   signatureRule{Scheme: "stripe", Secret: stripeSecret},
+			header: map[string]string{"Stripe-Signature": "t=" + stripeTS + ",v1=" + stripeSig},
+			body:   stripeBody + " ", now: at(stripeTS),
+		},
+		{
+			name:   "stripe stale timestamp",
+			rule:   signatureRule{Scheme: "stripe", Secret: stripeSecret},
+			header: map[string]string{"Stripe-Signature": "t=" + stripeTS + ",v1=" + stripeSig},
+			body:   stripeBody, now: at(stripeTS).Add(301 * time.Second),
+		},
+		{
+			name:   "stripe within custom tolerance",
+			rule:   signatureRule{Scheme: "stripe", Secret: stripeSecret, Tolerance: 600},
+			header: map[string]string{"Stripe-Signature": "t=" + stripeTS + ",v1=" + stripeSig},
+			body:   stripeBody, now: at(stripeTS).Add(-599 * time.Second), ok: true,
+		},
+		{
+			name:   "stripe without timestamp",
+			rule:   signatureRule{Scheme: "stripe", Secret: stripeSecret},
+			header: map[string]string{"Stripe-Signature": "v1=" + stripeSig},
+			body:   stripeBody, now: at(stripeTS),
+		},
+		{
+			name: "stripe missing header",
+			rule: signatureRule{Scheme: "stripe", Secret: stripeSecret},
+			body: stripeBody, now: at(stripeTS),
+		},
+		{
+			name:   "github",
+			rule:   signatureRule{Scheme: "github", Secret: githubSecret},
+			header: map[string]string{"X-Hub-Signature-256": githubSig},
+			body:   githubBody, ok: true,
+		},
+		{
+			name:   "github without sha256= prefix",
+			rule:   signatureRule{Scheme: "github", Secret: githubSecret},
+			header: map[string]string{"X-Hub-Signature-256": githubSig[len("sha256="):]},
+			body:   githubBody,
+		},
+		{
+			name:   "github wrong secret",
+			rule:   signatureRule{Scheme: "github", Secret: "not it"},
+			header: map[string]string{"X-Hub-Signature-256": githubSig},
+			body:   githubBody,
+		},
+		{
+			name:   "github missing header",
+			rule:   signatureRule{Scheme: "github", Secret: githubSecret},
+			header: map[string]string{"X-Hub-Signature": githubSig},
+			body:   githubBody,
+		},
+		{
+			name:   "slack",
+			rule:   signatureRule{Scheme: "slack", Secret: slackSecret},
+			header: map[string]string{"X-Slack-Signature": slackSig, "X-Slack-Request-Timestamp": slackTS},
+			body:   slackBody, now: at(slackTS), ok: true,
+		},
+		{
+			name:   "slack without v0= prefix",
+			rule:   signatureRule{Scheme: "slack", Secret: slackSecret},
+			header: map[string]string{"X-Slack-Signature": slackSig[len("v0="):], "X-Slack-Request-Timestamp": slackTS},
+			body:   slackBody, now: at(slackTS),
+		},
+		{
+			name:   "slack bad signature",
+			rule:   signatureRule{Scheme: "slack", Secret: slackSecret},
+			header: map[string]string{"X-Slack-Signature": slackSig, "X-Slack-Request-Timestamp": slackTS},
+			body:   slackBody + "&x=1", now: at(slackTS),
+		},
+		{
+			name:   "slack stale timestamp",
+			rule:   signatureRule{Scheme: "slack", Secret: slackSecret},
+			header: map[string]string{"X-Slack-Signature": slackSig, "X-Slack-Request-Timestamp": slackTS},
+			body:   slackBody, now: at(slackTS).Add(10 * time.Minute),
+		},
+		{
+			name:   "slack missing timestamp",
+			rule:   signatureRule{Scheme: "slack", Secret: slackSecret},
+			header: map[string]string{"X-Slack-Signature": slackSig},
+			body:   slackBody, now: at(slackTS),
+		},
+		{
+			name:   "hmac sha256",
+			rule:   signatureRule{Scheme: "hmac", Header: "X-Signature", Secret: "Jefe"},
+			header: map[string]string{"X-Signature": hmacSHA256},
+			body:   hmacBody, ok: true,
+		},
+		{
+			name:   "hmac sha1",
+			rule:   signatureRule{Scheme: "hmac", Header: "X-Signature", Secret: "Jefe", Algorithm: "sha1"},
+			header: map[string]string{"X-Signature": hmacSHA1},
+			body:   hmacBody, ok: true,
+		},
+		{
+			name:   "hmac sha512",
+			rule:   signatureRule{Scheme: "hmac", Header: "X-Signature", Secret: "Jefe", Algorithm: "sha512"},
+			header: map[string]string{"X-Signature": hmacSHA512},
+			body:   hmacBody, ok: true,
+		},
+		{
+			name:   "hmac base64 with prefix",
+			rule:   signatureRule{Scheme: "hmac", Header: "X-Signature", Secret: "Jefe", Encoding: "base64", Prefix: "sha256="},
+			header: map[string]string{"X-Signature": "sha256=" + hmacSHA256B64},
+			body:   hmacBody, ok: true,
+		},
+		{
+			name:   "hmac hex where base64 expected",
+			rule:   signatureRule{Scheme: "hmac", Header: "X-Signature", Secret: "Jefe", Encoding: "base64"},
+			header: map[string]string{"X-Signature": hmacSHA256},
+			body:   hmacBody,
+		},
+		{
+			name:   "hmac wrong algorithm",
+			rule:   signatureRule{Scheme: "hmac", Header: "X-Signature", Secret: "Jefe", Algorithm: "sha512"},
+			header: map[string]string{"X-Signature": hmacSHA256},
+			body:   hmacBody,
+		},
+		{
+			name:   "hmac with timestamp",
+			rule:   signatureRule{Scheme: "hmac", Header: "X-Signature", Secret: "Jefe", TimestampHeader: "X-Timestamp"},
+			header: map[string]string{"X-Signature": hmacTimed, "X-Timestamp": stripeTS},
+			body:   hmacBody, now: at(stripeTS).Add(-time.Minute), ok: true,
+		},
+		{
+			name:   "hmac stale timestamp",
+			rule:   signatureRule{Scheme: "hmac", Header: "X-Signature", Secret: "Jefe", TimestampHeader: "X-Timestamp", Tolerance: 30},
+			header: map[string]string{"X-Signature": hmacTimed, "X-Timestamp": stripeTS},
+			body:   hmacBody, now: at(stripeTS).Add(-time.Minute),
+		},
+		{
+			name:   "hmac invalid timestamp",
+			rule:   signatureRule{Scheme: "hmac", Header: "X-Signature", Secret: "Jefe", TimestampHeader: "X-Timestamp"},
+			header: map[string]string{"X-Signature": hmacTimed, "X-Timestamp": "soon"},
+			body:   hmacBody, now: at(stripeTS),
+		},
+		{
+			name:   "hmac missing header",
+			rule:   signatureRule{Scheme: "hmac", Header: "X-Signature", Secret: "Jefe"},
+			header: map[string]string{"X-Other": hmacSHA256},
+			body:   hmacBody,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := tt.rule
+			rule.Path = "/hooks"
+			if err := rule.normalize(); err != nil {
+				t.Fatalf("normalize: %v", err)
+			}
+			h := http.Header{}
+			for k, v := range tt.header {
+				h.Set(k, v)
+			}
+			err := rule.verify(h, []byte(tt.body), tt.now)
+			if (err == nil) != tt.ok {
+				t.Errorf("verify = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSignatureMissingHeader(t *testing.T) {
+	rule := signatureRule{Path: "/", Scheme: "github", Secret: githubSecret}
+	if err := rule.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.verify(http.Header{}, []byte(githubBody), time.Now()); err != errSignatureMissing {
+		t.Errorf("verify = %v, want errSignatureMissing", err)
+	}
+}
+
+func TestSignatureRuleNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		rule signatureRule
+		ok   bool
+	}{
+		{"github", signatureRule{Path: "/gh", Scheme: "github", Secret: "s"}, true},
+		{"no path", signatureRule{Scheme: "github", Secret: "s"}, false},
+		{"relative path", signatureRule{Path: "gh", Scheme: "github", Secret: "s"}, false},
+		{"no secret", signatureRule{Path: "/gh", Scheme: "github"}, false},
+		{"unknown scheme", signatureRule{Path: "/gh", Scheme: "gitlab", Secret: "s"}, false},
+		{"hmac without header", signatureRule{Path: "/h", Scheme: "hmac", Secret: "s"}, false},
+		{"bad algorithm", signatureRule{Path: "/h", Scheme: "hmac", Header: "X-Sig", Secret: "s", Algorithm: "md5"}, false},
+		{"bad encoding", signatureRule{Path: "/h", Scheme: "hmac", Header: "X-Sig", Secret: "s", Encoding: "base32"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.normalize(); (err == nil) != tt.ok {
+				t.Errorf("normalize = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestMatchSignatureRule(t *testing.T) {
+	rules := []signatureRule{{Path: "/hooks"}, {Path: "/hooks/stripe"}, {Path: "/api"}}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/hooks/github", "/hooks"},
+		{"/hooks/stripe/events", "/hooks/stripe"},
+		{"/api", "/api"},
+		{"/other", ""},
+	}
+	for _, tt := range tests {
+		got := matchSignatureRule(rules, tt.path)
+		if (got == nil && tt.want != "") || (got != nil && got.Path != tt.want) {
+			t.Errorf("matchSignatureRule(%q) = %v, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Streaming responses (Server-Sent Events, NDJSON, multipart/x-mixed-replace, or anything
+// sent with X-Accel-Buffering: no) pass straight through: they are never buffered for the
+// overlay, have no write deadline, get keepalive comments while idle (event streams) and
+// are counted in streamingStreams instead of activeStreams.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+var streamingContentTypes = []string{"text/event-stream", "application/x-ndjson", "application/stream+json", "multipart/x-mixed-replace"}
+
+// sseKeepAlive is how long an event stream may stay silent before the gateway writes a
+// comment line, so idle proxies and load balancers keep it open (0 disables).
+var sseKeepAlive = 15 * time.Second
+
+func isStreamingResponse(h http.Header) bool {
+	if strings.EqualFold(h.Get("X-Accel-Buffering"), "no") {
+		return true
+	}
+	ct := strings.ToLower(h.Get("Content-Type"))
+	for _, t := range streamingContentTypes {
+		if strings.HasPrefix(ct, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func isEventStream(h http.Header) bool {
+	return strings.HasPrefix(strings.ToLower(h.Get("Content-Type")), "text/event-stream")
+}
+
+// startStreaming moves a stream to the streaming count when its response headers arrive.
+// The caller holds sc.mu.
+func (tc *tunnelConn) startStreaming(sc *streamCtx) {
+	sc.streaming = true
+	tc.activeStreams.Add(-1)
+	tc.streamingStreams.Add(1)
+	// Not every writer supports deadlines (replays buffer the response); that is fine.
+	_ = http.NewResponseController(sc.w).SetWriteDeadline(time.Time{})
+	sc.w.Header().Set("X-Accel-Buffering", "no")
+	// Comments can only be spliced into plain text; an encoded stream would be corrupted.
+	enc := strings.TrimSpace(sc.w.Header().Get("Content-Encoding"))
+	if sseKeepAlive > 0 && isEventStream(sc.w.Header()) && (enc == "" || strings.EqualFold(enc, "identity")) {
+		sc.lastWrite = time.Now()
+		go sc.keepAlive()
+	}
+}
+
+// keepAlive writes an SSE comment when the stream has been idle for sseKeepAlive. It only
+// writes between lines so it never splits an event.
+func (sc *streamCtx) keepAlive() {
+	ticker := time.NewTicker(sseKeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sc.done:
+			return
+		case now := <-ticker.C:
+			sc.mu.Lock()
+			if !sc.ended && sc.lineStart && now.Sub(sc.lastWrite) >= sseKeepAlive {
+				if _, err := sc.w.Write([]byte(": keepalive\n")); err == nil && sc.flusher != nil {
+					sc.flusher.Flush()
+				}
+				sc.lastWrite = now
+			}
+			sc.mu.Unlock()
+		}
+	}
+}
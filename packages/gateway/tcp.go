@@ -0,0 +1,216 @@
+// Raw TCP tunnels: a tunnel opened with X-Wormkey-Tunnel-Mode: tcp gets a public port.
+// Each accepted connection is a TCP_OPEN stream; bytes flow as STREAM_DATA both ways and
+// STREAM_END half-closes the sending side. TLS passthrough connections use the same streams.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tcpWriteTimeout = 10 * time.Second // a stalled client gets its connection closed
+	tcpReadChunk    = 32 << 10
+	// tcpWriteQueue is how many STREAM_DATA frames may wait for a slow public client before
+	// its connection is closed; the tunnel read loop never blocks on one client.
+	tcpWriteQueue = 64
+)
+
+// tcpStream is one public connection carried over the tunnel.
+type tcpStream struct {
+	conn     net.Conn
+	viewerID string
+	writes   chan []byte // STREAM_DATA for the public client; closed on STREAM_END
+	ended    bool        // STREAM_END queued; only touched by the tunnel read loop
+	mu       sync.Mutex
+	localEOF bool // CLI sent STREAM_END and everything before it was written
+	peerEOF  bool // public client closed its write side
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (s *tcpStream) finish() {
+	s.once.Do(func() {
+		s.conn.Close()
+		close(s.done)
+	})
+}
+
+// serveTCP accepts public connections for a slug's port.
+func serveTCP(tunnels *sync.Map, slug string, ln io.Closer) {
+	for {
+		conn, err := ln.(net.Listener).Accept()
+		if err != nil {
+			return
+		}
+		go handleTCPConn(tunnels, slug, conn, "tcp")
+	}
+}
+
+// handleTCPConn carries one public connection over the slug's tunnel. mode is "tcp" for
+// public ports and "tls" for SNI-routed passthrough connections.
+func handleTCPConn(tunnels *sync.Map, slug string, conn net.Conn, mode string) {
+	counter := metrics.tcpConnections
+	if mode == "tls" {
+		counter = metrics.passthroughConnections
+	}
+	val, ok := tunnels.Load(slug)
+	if !ok {
+		counter.Inc("not_active")
+		conn.Close()
+		return
+	}
+	tc := val.(*tunnelConn)
+	viewerID := rawViewerID(conn.RemoteAddr())
+	reason := "not_" + mode
+	if tc.mode == mode {
+		reason = tc.admitRaw(viewerID, conn.RemoteAddr().String())
+	}
+	if reason != "" {
+		metrics.policyRejections.Inc(reason)
+		counter.Inc("rejected")
+		conn.Close()
+		return
+	}
+
+	streamID := tc.streamID.Add(1)
+	s := &tcpStream{conn: conn, viewerID: viewerID, writes: make(chan []byte, tcpWriteQueue), done: make(chan struct{})}
+	tc.tcpStreams.Store(streamID, s)
+	tc.activeStreams.Add(1)
+	counter.Inc("accepted")
+	defer func() {
+		tc.tcpStreams.Delete(streamID)
+		tc.activeStreams.Add(-1)
+	}()
+	if err := tc.writeFrame(makeFrame(FrameTCPOpen, streamID, []byte(conn.RemoteAddr().String()))); err != nil {
+		s.finish()
+		return
+	}
+	go tc.writeTCP(streamID, s)
+
+	// public client -> tunnel
+	go func() {
+		buf := make([]byte, tcpReadChunk)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				metrics.bytes.Add(float64(n), "in")
+				if tc.writeFrame(makeFrame(FrameStreamData, streamID, buf[:n])) != nil {
+					s.finish()
+					return
+				}
+			}
+			if err != nil {
+				s.mu.Lock()
+				select {
+				case <-s.done:
+					s.mu.Unlock()
+					return
+				default:
+				}
+				s.peerEOF = true
+				both := s.localEOF
+				s.mu.Unlock()
+				_ = tc.writeFrame(makeFrame(FrameStreamEnd, streamID, nil))
+				if both {
+					s.finish()
+				}
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-s.done:
+	case <-tc.closed:
+		s.finish()
+	}
+}
+
+// handleTCPFrame routes a CLI frame for a TCP stream. It reports false if streamID is
+// not a TCP stream.
+func (tc *tunnelConn) handleTCPFrame(ftype byte, streamID uint32, payload []byte) bool {
+	v, ok := tc.tcpStreams.Load(streamID)
+	if !ok {
+		return false
+	}
+	s := v.(*tcpStream)
+	switch ftype {
+	case FrameStreamData:
+		if s.ended {
+			return true
+		}
+		select {
+		case <-s.done:
+		case s.writes <- payload:
+		default:
+			// The client is not reading; drop its connection rather than buffer more.
+			_ = tc.writeFrame(makeFrame(FrameStreamCancel, streamID, nil))
+			s.finish()
+		}
+	case FrameStreamEnd:
+		if !s.ended {
+			s.ended = true
+			close(s.writes)
+		}
+	case FrameStreamCancel:
+		s.finish()
+	default:
+		return false
+	}
+	return true
+}
+
+// writeTCP writes queued STREAM_DATA to the public client, then half-closes it once the
+// queue is closed by STREAM_END.
+func (tc *tunnelConn) writeTCP(streamID uint32, s *tcpStream) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case payload, ok := <-s.writes:
+			if !ok {
+				s.mu.Lock()
+				s.localEOF = true
+				both := s.peerEOF
+				s.mu.Unlock()
+				if cw, ok := s.conn.(interface{ CloseWrite() error }); ok && !both {
+					_ = cw.CloseWrite()
+				} else {
+					s.finish()
+				}
+				return
+			}
+			_ = s.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+			if _, err := s.conn.Write(payload); err != nil {
+				_ = tc.writeFrame(makeFrame(FrameStreamCancel, streamID, nil))
+				s.finish()
+				return
+			}
+			metrics.bytes.Add(float64(len(payload)), "out")
+		}
+	}
+}
+
+// closeTCPViewer drops every TCP connection from a kicked viewer.
+func (tc *tunnelConn) closeTCPViewer(viewerID string) {
+	tc.tcpStreams.Range(func(k, v any) bool {
+		if s := v.(*tcpStream); s.viewerID == viewerID {
+			_ = tc.writeFrame(makeFrame(FrameStreamCancel, k.(uint32), nil))
+			s.finish()
+		}
+		return true
+	})
+}
+
+func makeFrame(ftype byte, streamID uint32, payload []byte) []byte {
+	f := make([]byte, 5+len(payload))
+	f[0] = ftype
+	binary.BigEndian.PutUint32(f[1:5], streamID)
+	copy(f[5:], payload)
+	return f
+}
@@ -0,0 +1,721 @@
+// Native TLS termination: certificates from files or ACME (DNS-01, so wildcards work),
+// renewed in the background, plus the HTTP->HTTPS redirect listener and HSTS.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	letsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+	certCheckInterval    = 12 * time.Hour
+	certFileCheck        = time.Minute
+	managedCheck         = time.Minute // how often renewal loops check that their custom domain is still verified
+	onDemandRetryMin     = time.Minute // backoff after a failed on-demand order, doubling per failure
+	onDemandRetryMax     = time.Hour
+	registerRetryMin     = 10 * time.Second // backoff after a failed account registration, doubling per failure
+	registerRetryMax     = 10 * time.Minute
+)
+
+// dnsProvider publishes and removes the _acme-challenge TXT records for DNS-01.
+// fqdn is the full record name with a trailing dot; value is the TXT content.
+type dnsProvider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// dnsProviders maps WORMKEY_ACME_DNS_PROVIDER values to constructors. Add new DNS
+// hosts here.
+var dnsProviders = map[string]func() (dnsProvider, error){
+	"exec":         newExecDNSProvider,
+	"httpreq":      newHTTPReqDNSProvider,
+	"challtestsrv": newChallTestSrvDNSProvider,
+}
+
+// execDNSProvider runs `$WORMKEY_ACME_DNS_EXEC present|cleanup <fqdn> <value>`.
+type execDNSProvider struct{ path string }
+
+func newExecDNSProvider() (dnsProvider, error) {
+	path := os.Getenv("WORMKEY_ACME_DNS_EXEC")
+	if path == "" {
+		return nil, errors.New("WORMKEY_ACME_DNS_EXEC is required for the exec DNS provider")
+	}
+	return &execDNSProvider{path: path}, nil
+}
+
+func (p *execDNSProvider) run(ctx context.Context, action, fqdn, value string) error {
+	out, err := exec.CommandContext(ctx, p.path, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", p.path, action, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (p *execDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+// httpReqDNSProvider POSTs {"fqdn","value"} to $WORMKEY_ACME_DNS_URL/present and /cleanup.
+type httpReqDNSProvider struct{ base string }
+
+func newHTTPReqDNSProvider() (dnsProvider, error) {
+	base := os.Getenv("WORMKEY_ACME_DNS_URL")
+	if base == "" {
+		return nil, errors.New("WORMKEY_ACME_DNS_URL is required for the httpreq DNS provider")
+	}
+	return &httpReqDNSProvider{base: strings.TrimRight(base, "/")}, nil
+}
+
+func (p *httpReqDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return postDNSRequest(ctx, p.base+"/present", map[string]string{"fqdn": fqdn, "value": value})
+}
+
+func (p *httpReqDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return postDNSRequest(ctx, p.base+"/cleanup", map[string]string{"fqdn": fqdn, "value": value})
+}
+
+// challTestSrvDNSProvider drives Pebble's pebble-challtestsrv management API, for local testing.
+type challTestSrvDNSProvider struct{ base string }
+
+func newChallTestSrvDNSProvider() (dnsProvider, error) {
+	return &challTestSrvDNSProvider{base: strings.TrimRight(getEnv("WORMKEY_ACME_DNS_URL", "http://localhost:8055"), "/")}, nil
+}
+
+func (p *challTestSrvDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return postDNSRequest(ctx, p.base+"/set-txt", map[string]string{"host": fqdn, "value": value})
+}
+
+func (p *challTestSrvDNSProvider) CleanUp(ctx context.Context, fqdn, _ string) error {
+	return postDNSRequest(ctx, p.base+"/clear-txt", map[string]string{"host": fqdn})
+}
+
+func postDNSRequest(ctx context.Context, url string, body any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// certStore serves the certificate matching the SNI name of each handshake. With an
+// issuer and onDemand set, verified custom domains get certificates on first use.
+type certStore struct {
+	mu       sync.RWMutex
+	certs    map[string]*tls.Certificate // keyed by the certificate's first DNS name
+	issuer   *acmeIssuer
+	onDemand bool
+	obtainMu sync.Mutex
+	issuing  map[string]bool            // hosts with an on-demand order in progress
+	failures map[string]onDemandFailure // hosts whose last on-demand order failed
+}
+
+// onDemandFailure backs off on-demand orders for a host, so handshakes for a domain that
+// cannot be validated do not start a new order each time.
+type onDemandFailure struct {
+	attempts int
+	retryAt  time.Time
+}
+
+func newCertStore() *certStore {
+	return &certStore{certs: map[string]*tls.Certificate{}, issuing: map[string]bool{}, failures: map[string]onDemandFailure{}}
+}
+
+func (cs *certStore) put(name string, cert *tls.Certificate) {
+	cs.mu.Lock()
+	cs.certs[name] = cert
+	cs.mu.Unlock()
+}
+
+func (cs *certStore) remove(name string) {
+	cs.mu.Lock()
+	delete(cs.certs, name)
+	cs.mu.Unlock()
+}
+
+func (cs *certStore) get(name string) *tls.Certificate {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.certs[name]
+}
+
+func (cs *certStore) lookup(serverName string) (match, fallback *tls.Certificate) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for _, cert := range cs.certs {
+		if fallback == nil {
+			fallback = cert
+		}
+		if serverName != "" && cert.Leaf != nil && cert.Leaf.VerifyHostname(serverName) == nil {
+			return cert, fallback
+		}
+	}
+	return nil, fallback
+}
+
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := normalizeHostname(hello.ServerName)
+	match, fallback := cs.lookup(name)
+	if match != nil {
+		return match, nil
+	}
+	if cs.onDemand && cs.issuer != nil && domains.verified(name) {
+		// Issuing takes seconds to minutes; serve the fallback meanwhile.
+		cs.obtainOnDemand(name)
+	}
+	if fallback == nil {
+		return nil, errors.New("no certificate available")
+	}
+	return fallback, nil
+}
+
+// obtainOnDemand starts issuing (or loading from cache) a certificate for a verified
+// custom domain in the background and keeps it renewed while the domain stays verified.
+// It does nothing while an order for host is running or backing off after a failure.
+func (cs *certStore) obtainOnDemand(host string) {
+	cs.obtainMu.Lock()
+	defer cs.obtainMu.Unlock()
+	if cs.issuing[host] || time.Now().Before(cs.failures[host].retryAt) {
+		return
+	}
+	cs.issuing[host] = true
+	go func() {
+		err := cs.issuer.manage(cs, []string{host}, "http-01", func() bool { return domains.verified(host) })
+		cs.obtainMu.Lock()
+		defer cs.obtainMu.Unlock()
+		delete(cs.issuing, host)
+		if err == nil {
+			delete(cs.failures, host)
+			return
+		}
+		f := cs.failures[host]
+		f.attempts++
+		backoff := onDemandRetryMax
+		if f.attempts < 7 {
+			backoff = min(onDemandRetryMin<<(f.attempts-1), onDemandRetryMax)
+		}
+		f.retryAt = time.Now().Add(backoff)
+		cs.failures[host] = f
+		log.Printf("tls: on-demand certificate for %s: %v (retry in %s)", host, err, backoff)
+	}()
+}
+
+// serveHTTP01 answers ACME HTTP-01 challenges on the plain HTTP listener.
+func (cs *certStore) serveHTTP01(next http.Handler) http.Handler {
+	if cs.issuer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/"); ok {
+			if keyAuth, ok := cs.issuer.http01.Load(token); ok {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, keyAuth.(string))
+				return
+			}
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loadCertFiles loads a PEM certificate chain and key and keeps them reloaded when the
+// files change (e.g. renewed by certbot or a Kubernetes secret update).
+func (cs *certStore) loadCertFiles(certFile, keyFile string) error {
+	load := func() (time.Time, error) {
+		st, err := os.Stat(certFile)
+		if err != nil {
+			return time.Time{}, err
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return time.Time{}, err
+		}
+		cs.put(certFile, &cert)
+		return st.ModTime(), nil
+	}
+	mod, err := load()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(certFileCheck) {
+			st, err := os.Stat(certFile)
+			if err != nil || !st.ModTime().After(mod) {
+				continue
+			}
+			if m, err := load(); err != nil {
+				log.Printf("tls: reload %s: %v", certFile, err)
+			} else {
+				mod = m
+				log.Printf("tls: reloaded %s", certFile)
+			}
+		}
+	}()
+	return nil
+}
+
+// acmeIssuer obtains certificates over ACME and caches them on disk. Base domains use
+// DNS-01 (wildcards); custom domains use HTTP-01 served by the plain listener.
+type acmeIssuer struct {
+	client      *acme.Client
+	email       string
+	dns         dnsProvider   // nil when only HTTP-01 is used
+	http01      sync.Map      // token -> key authorization
+	dir         string        // cache directory for the account key and certificates
+	propagation time.Duration // wait after publishing TXT records before asking for validation
+	regMu       sync.Mutex
+	registered  bool      // set once the CA accepted the account; failures are retried
+	regErr      error     // last registration failure, returned until regRetryAt
+	regFailures int       // consecutive registration failures
+	regRetryAt  time.Time // no new registration attempt before this
+}
+
+func newACMEIssuer() (*acmeIssuer, error) {
+	var dns dnsProvider
+	if name := os.Getenv("WORMKEY_ACME_DNS_PROVIDER"); name != "" {
+		newProvider, ok := dnsProviders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown WORMKEY_ACME_DNS_PROVIDER %q", name)
+		}
+		var err error
+		if dns, err = newProvider(); err != nil {
+			return nil, err
+		}
+	}
+	dir := getEnv("WORMKEY_ACME_DIR", "data/acme")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateKey(filepath.Join(dir, "account.key"))
+	if err != nil {
+		return nil, err
+	}
+	httpClient := http.DefaultClient
+	if root := os.Getenv("WORMKEY_ACME_CA_ROOT"); root != "" {
+		// Trust a private ACME server's HTTPS certificate (e.g. Pebble's minica root).
+		pemBytes, err := os.ReadFile(root)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("no certificates in %s", root)
+		}
+		httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+	propagation, err := time.ParseDuration(getEnv("WORMKEY_ACME_DNS_PROPAGATION", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("WORMKEY_ACME_DNS_PROPAGATION: %w", err)
+	}
+	return &acmeIssuer{
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: getEnv("WORMKEY_ACME_DIRECTORY", letsEncryptDirectory),
+			HTTPClient:   httpClient,
+			UserAgent:    "wormkey-gateway",
+		},
+		email:       os.Getenv("WORMKEY_ACME_EMAIL"),
+		dns:         dns,
+		dir:         dir,
+		propagation: propagation,
+	}, nil
+}
+
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	if b, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// register creates (or finds) the ACME account. Only success is remembered: a failure is
+// returned to callers until its backoff has passed, then registration is tried again.
+func (ai *acmeIssuer) register(ctx context.Context) error {
+	ai.regMu.Lock()
+	defer ai.regMu.Unlock()
+	if ai.registered {
+		return nil
+	}
+	if time.Now().Before(ai.regRetryAt) {
+		return ai.regErr
+	}
+	acct := &acme.Account{}
+	if ai.email != "" {
+		acct.Contact = []string{"mailto:" + ai.email}
+	}
+	_, err := ai.client.Register(ctx, acct, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		ai.regFailures++
+		backoff := registerRetryMax
+		if ai.regFailures < 8 {
+			backoff = min(registerRetryMin<<(ai.regFailures-1), registerRetryMax)
+		}
+		ai.regRetryAt, ai.regErr = time.Now().Add(backoff), err
+		return err
+	}
+	ai.registered, ai.regErr, ai.regFailures = true, nil, 0
+	return nil
+}
+
+// certFileName is the cache file stem for a set of names ("*.wormkey.run" -> "_wildcard.wormkey.run").
+func certFileName(domains []string) string {
+	return strings.ReplaceAll(domains[0], "*", "_wildcard")
+}
+
+// cached returns the on-disk certificate for domains, if any.
+func (ai *acmeIssuer) cached(domains []string) *tls.Certificate {
+	stem := filepath.Join(ai.dir, certFileName(domains))
+	cert, err := tls.LoadX509KeyPair(stem+".crt", stem+".key")
+	if err != nil {
+		return nil
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil
+	}
+	for _, d := range domains {
+		if cert.Leaf.VerifyHostname(strings.Replace(d, "*", "x", 1)) != nil {
+			return nil // the configured names changed
+		}
+	}
+	return &cert
+}
+
+// obtain runs a full ACME order for names using chalType ("dns-01" or "http-01") and stores
+// the result in the cache directory.
+func (ai *acmeIssuer) obtain(ctx context.Context, names []string, chalType string) (*tls.Certificate, error) {
+	if err := ai.register(ctx); err != nil {
+		return nil, fmt.Errorf("acme register: %w", err)
+	}
+	order, err := ai.client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, fmt.Errorf("acme order: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := ai.authorize(ctx, authzURL, chalType); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := ai.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, fmt.Errorf("acme wait order: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := ai.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		// Servers that finalize asynchronously without a Location header (Pebble) leave
+		// the client polling an empty URL; poll the order we already know instead.
+		done, werr := ai.client.WaitOrder(ctx, order.URI)
+		if werr != nil || done.CertURL == "" {
+			return nil, fmt.Errorf("acme finalize: %w", err)
+		}
+		if chain, err = ai.client.FetchCert(ctx, done.CertURL, true); err != nil {
+			return nil, fmt.Errorf("acme fetch certificate: %w", err)
+		}
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := ai.save(names, chain, key); err != nil {
+		log.Printf("tls: cache certificate: %v", err)
+	}
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func (ai *acmeIssuer) authorize(ctx context.Context, authzURL, chalType string) error {
+	authz, err := ai.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("acme authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == chalType {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("acme: no %s challenge offered for %s", chalType, authz.Identifier.Value)
+	}
+	if chalType == "http-01" {
+		keyAuth, err := ai.client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		ai.http01.Store(chal.Token, keyAuth)
+		defer ai.http01.Delete(chal.Token)
+		return ai.accept(ctx, authz, chal)
+	}
+	if ai.dns == nil {
+		return errors.New("WORMKEY_ACME_DNS_PROVIDER is required for dns-01")
+	}
+	value, err := ai.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	// Wildcard identifiers arrive without the "*." prefix, so this is the base name either way.
+	fqdn := "_acme-challenge." + authz.Identifier.Value + "."
+	if err := ai.dns.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("dns present %s: %w", fqdn, err)
+	}
+	defer func() {
+		if err := ai.dns.CleanUp(context.Background(), fqdn, value); err != nil {
+			log.Printf("tls: dns cleanup %s: %v", fqdn, err)
+		}
+	}()
+	if ai.propagation > 0 {
+		select {
+		case <-time.After(ai.propagation):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return ai.accept(ctx, authz, chal)
+}
+
+func (ai *acmeIssuer) accept(ctx context.Context, authz *acme.Authorization, chal *acme.Challenge) error {
+	if _, err := ai.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("acme accept %s: %w", authz.Identifier.Value, err)
+	}
+	if _, err := ai.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("acme validate %s: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+func (ai *acmeIssuer) save(domains []string, chain [][]byte, key *ecdsa.PrivateKey) error {
+	var certPEM bytes.Buffer
+	for _, der := range chain {
+		pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	stem := filepath.Join(ai.dir, certFileName(domains))
+	if err := os.WriteFile(stem+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(stem+".crt", certPEM.Bytes(), 0o600)
+}
+
+// needsRenewal reports whether less than a third of the certificate's lifetime remains.
+func needsRenewal(cert *tls.Certificate) bool {
+	if cert == nil || cert.Leaf == nil {
+		return true
+	}
+	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	return time.Until(cert.Leaf.NotAfter) < lifetime/3
+}
+
+// manage keeps a certificate for domains in the store, renewing it in the background.
+// With keep set, renewal stops and the certificate is dropped once keep returns false.
+func (ai *acmeIssuer) manage(store *certStore, domains []string, chalType string, keep func() bool) error {
+	cert := ai.cached(domains)
+	if needsRenewal(cert) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		fresh, err := ai.obtain(ctx, domains, chalType)
+		cancel()
+		if err != nil && cert == nil {
+			return err
+		}
+		if err != nil {
+			log.Printf("tls: renewal of %s failed, serving cached certificate: %v", domains[0], err)
+		} else {
+			cert = fresh
+			log.Printf("tls: obtained certificate for %s (expires %s)", strings.Join(domains, ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+	store.put(domains[0], cert)
+	go func() {
+		var next time.Time
+		for {
+			if next.IsZero() {
+				wait := certCheckInterval
+				if c := store.get(domains[0]); c != nil && c.Leaf != nil {
+					// Short-lived certificates (e.g. Pebble's) need checking sooner than every 12h.
+					if third := c.Leaf.NotAfter.Sub(c.Leaf.NotBefore) / 3; third/2 < wait {
+						wait = third / 2
+					}
+				}
+				next = time.Now().Add(wait)
+			}
+			if keep == nil {
+				time.Sleep(time.Until(next))
+			} else {
+				time.Sleep(min(time.Until(next), managedCheck))
+				if !keep() {
+					store.remove(domains[0])
+					log.Printf("tls: stopped managing certificate for %s", domains[0])
+					return
+				}
+			}
+			if time.Now().Before(next) {
+				continue
+			}
+			next = time.Time{}
+			if !needsRenewal(store.get(domains[0])) {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			fresh, err := ai.obtain(ctx, domains, chalType)
+			cancel()
+			if err != nil {
+				log.Printf("tls: renew %s: %v", domains[0], err)
+				continue
+			}
+			store.put(domains[0], fresh)
+			log.Printf("tls: renewed certificate for %s (expires %s)", domains[0], fresh.Leaf.NotAfter.Format(time.RFC3339))
+		}
+	}()
+	return nil
+}
+
+// tlsFromEnv builds the certificate store from WORMKEY_TLS_CERT/WORMKEY_TLS_KEY,
+// WORMKEY_ACME_DOMAINS and WORMKEY_ACME_CUSTOM_DOMAINS. It returns nil when TLS is not
+// configured.
+func tlsFromEnv() (*certStore, error) {
+	certFile, keyFile := os.Getenv("WORMKEY_TLS_CERT"), os.Getenv("WORMKEY_TLS_KEY")
+	acmeDomains := splitList(os.Getenv("WORMKEY_ACME_DOMAINS"))
+	onDemand := os.Getenv("WORMKEY_ACME_CUSTOM_DOMAINS") == "true"
+	if certFile == "" && len(acmeDomains) == 0 && !onDemand {
+		return nil, nil
+	}
+	store := newCertStore()
+	if certFile != "" {
+		if keyFile == "" {
+			return nil, errors.New("WORMKEY_TLS_KEY is required with WORMKEY_TLS_CERT")
+		}
+		if err := store.loadCertFiles(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("load %s: %w", certFile, err)
+		}
+	}
+	if len(acmeDomains) > 0 || onDemand {
+		issuer, err := newACMEIssuer()
+		if err != nil {
+			return nil, err
+		}
+		store.issuer, store.onDemand = issuer, onDemand
+	}
+	if len(acmeDomains) > 0 {
+		if err := store.issuer.manage(store, acmeDomains, "dns-01", nil); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// withHSTS adds Strict-Transport-Security to every HTTPS response.
+func withHSTS(next http.Handler, maxAge int, includeSubdomains bool) http.Handler {
+	value := "max-age=" + strconv.Itoa(maxAge)
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS sends plain HTTP requests to the TLS listener. /health stays on HTTP
+// so load balancer checks keep working.
+func redirectToHTTPS(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.Write([]byte("ok"))
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
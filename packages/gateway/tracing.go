@@ -0,0 +1,93 @@
+// OpenTelemetry tracing: edge receipt -> tunnel frame write -> first RESPONSE_HEADERS -> body streaming.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/wormkey/gateway")
+
+// initTracing installs an OTLP/HTTP exporter when OTEL_EXPORTER_OTLP_ENDPOINT (or the
+// traces-specific variant) is set, e.g. http://localhost:4318 for a local collector.
+// W3C traceparent propagation is always on so upstream traces flow through to localhost.
+func initTracing() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		log.Printf("tracing disabled: %v", err)
+		return
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(getEnv("OTEL_SERVICE_NAME", "wormkey-gateway")))
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	))
+	log.Println("tracing enabled (OTLP/HTTP)")
+}
+
+// streamTrace tracks the tunnel-side spans of one proxied stream. Its methods are
+// called from the tunnel read loop; nil receivers are no-ops.
+type streamTrace struct {
+	ctx     context.Context
+	waitHdr trace.Span // OPEN_STREAM written -> RESPONSE_HEADERS received
+	body    trace.Span // RESPONSE_HEADERS -> STREAM_END
+	bytes   int64
+	once    sync.Once
+}
+
+func startStreamTrace(ctx context.Context, streamID uint32) *streamTrace {
+	st := &streamTrace{ctx: ctx}
+	_, st.waitHdr = tracer.Start(ctx, "tunnel.await_response_headers",
+		trace.WithAttributes(attribute.Int64("wormkey.stream_id", int64(streamID))))
+	return st
+}
+
+func (st *streamTrace) headersReceived(status int) {
+	if st == nil {
+		return
+	}
+	st.waitHdr.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	st.waitHdr.End()
+	_, st.body = tracer.Start(st.ctx, "tunnel.stream_body")
+}
+
+func (st *streamTrace) data(n int) {
+	if st != nil {
+		st.bytes += int64(n)
+	}
+}
+
+func (st *streamTrace) end(cancelled bool) {
+	if st == nil {
+		return
+	}
+	st.once.Do(func() {
+		span := st.body
+		if span == nil {
+			// Stream ended before any RESPONSE_HEADERS.
+			span = st.waitHdr
+		}
+		span.SetAttributes(attribute.Int64("wormkey.body_bytes", st.bytes))
+		if cancelled {
+			span.SetStatus(codes.Error, "stream cancelled")
+		}
+		span.End()
+	})
+}
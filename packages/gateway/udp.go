@@ -0,0 +1,142 @@
+// UDP tunnels: a tunnel opened with X-Wormkey-Tunnel-Mode: udp gets a public UDP port.
+// Each remote address becomes a virtual stream; packets travel as DATAGRAM frames and an
+// idle mapping is expired with STREAM_END.
+
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxDatagramSize = 64 << 10
+
+// udpIdleTimeout drops a remote address mapping after this long without packets.
+var udpIdleTimeout = time.Minute
+
+// udpFlow maps one remote address to a stream on the tunnel.
+type udpFlow struct {
+	streamID uint32
+	addr     net.Addr
+	pc       net.PacketConn
+	viewerID string
+	lastSeen atomic.Int64 // unix nanos of the last packet in either direction
+}
+
+func (f *udpFlow) touch() { f.lastSeen.Store(time.Now().UnixNano()) }
+
+// serveUDP reads packets for a slug's port and relays them to the slug's current tunnel.
+func serveUDP(tunnels *sync.Map, slug string, ln io.Closer) {
+	pc := ln.(net.PacketConn)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		val, ok := tunnels.Load(slug)
+		if !ok {
+			metrics.udpDatagrams.Inc("dropped")
+			continue
+		}
+		tc := val.(*tunnelConn)
+		if tc.mode != "udp" {
+			metrics.udpDatagrams.Inc("dropped")
+			continue
+		}
+		f := tc.udpFlow(pc, addr)
+		if f == nil {
+			metrics.udpDatagrams.Inc("dropped")
+			continue
+		}
+		f.touch()
+		metrics.udpDatagrams.Inc("in")
+		metrics.bytes.Add(float64(n), "in")
+		_ = tc.writeFrame(makeFrame(FrameDatagram, f.streamID, buf[:n]))
+	}
+}
+
+// udpFlow returns the mapping for addr, creating one if the viewer policy allows it.
+func (tc *tunnelConn) udpFlow(pc net.PacketConn, addr net.Addr) *udpFlow {
+	if v, ok := tc.udpByAddr.Load(addr.String()); ok {
+		return v.(*udpFlow)
+	}
+	viewerID := rawViewerID(addr)
+	if reason := tc.admitRaw(viewerID, addr.String()); reason != "" {
+		metrics.policyRejections.Inc(reason)
+		return nil
+	}
+	f := &udpFlow{streamID: tc.streamID.Add(1), addr: addr, pc: pc, viewerID: viewerID}
+	f.touch()
+	tc.udpFlows.Store(f.streamID, f)
+	tc.udpByAddr.Store(addr.String(), f)
+	tc.activeStreams.Add(1)
+	return f
+}
+
+func (tc *tunnelConn) dropUDPFlow(f *udpFlow, ftype byte) {
+	if _, ok := tc.udpFlows.LoadAndDelete(f.streamID); !ok {
+		return
+	}
+	tc.udpByAddr.Delete(f.addr.String())
+	tc.activeStreams.Add(-1)
+	if ftype != 0 {
+		_ = tc.writeFrame(makeFrame(ftype, f.streamID, nil))
+	}
+}
+
+// handleUDPFrame routes a CLI frame for a UDP flow. It reports false if the frame is not
+// for a UDP flow.
+func (tc *tunnelConn) handleUDPFrame(ftype byte, streamID uint32, payload []byte) bool {
+	v, ok := tc.udpFlows.Load(streamID)
+	if !ok {
+		return ftype == FrameDatagram // late reply to an expired flow
+	}
+	f := v.(*udpFlow)
+	switch ftype {
+	case FrameDatagram:
+		if _, err := f.pc.WriteTo(payload, f.addr); err == nil {
+			f.touch()
+			metrics.udpDatagrams.Inc("out")
+			metrics.bytes.Add(float64(len(payload)), "out")
+		}
+	case FrameStreamEnd, FrameStreamCancel:
+		tc.dropUDPFlow(f, 0)
+	default:
+		return false
+	}
+	return true
+}
+
+// expireUDPFlows ends idle mappings until the tunnel closes.
+func (tc *tunnelConn) expireUDPFlows() {
+	ticker := time.NewTicker(udpIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tc.closed:
+			return
+		case now := <-ticker.C:
+			tc.udpFlows.Range(func(_, v any) bool {
+				f := v.(*udpFlow)
+				if now.Sub(time.Unix(0, f.lastSeen.Load())) > udpIdleTimeout {
+					tc.dropUDPFlow(f, FrameStreamEnd)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// closeUDPViewer drops every mapping of a kicked viewer.
+func (tc *tunnelConn) closeUDPViewer(viewerID string) {
+	tc.udpFlows.Range(func(_, v any) bool {
+		if f := v.(*udpFlow); f.viewerID == viewerID {
+			tc.dropUDPFlow(f, FrameStreamCancel)
+		}
+		return true
+	})
+}